@@ -0,0 +1,148 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jellybean4/kcp_tran/kcp"
+	"github.com/spf13/cobra"
+)
+
+var (
+	kmode     *string
+	knodelay  *int
+	kinterval *int
+	kresend   *int
+	knc       *int
+	ksndwnd   *int
+	krcvwnd   *int
+	kmtu      *int
+	kminrto   *int
+	kdeadlink *int
+	kreadbuf  *int
+	kcc       *string
+	ksack     *bool
+	kdata     *int
+	kparity   *int
+	kpacing   *bool
+	kbw       *int
+	klinger   *int
+	kalive    *int
+	kidle     *int
+	ksndbuf   *int
+	ksndsegs  *int
+	kkey      *string
+	kcrypt    *string
+	kidentity *string
+	kpeers    *string
+)
+
+func init() {
+	flags := RootCmd.PersistentFlags()
+	kmode = flags.StringP("mode", "m", "turbo", "kcp preset: normal, fast or turbo")
+	knodelay = flags.Int("nodelay", 0, "1 enables kcp nodelay mode, overrides the preset")
+	kinterval = flags.Int("interval", 0, "kcp flush interval in millisec, overrides the preset")
+	kresend = flags.Int("resend", 0, "fast resend after this many out of order acks, overrides the preset")
+	knc = flags.Int("nc", 0, "1 disables congestion control, overrides the preset")
+	ksndwnd = flags.Int("sndwnd", 0, "send window in segments, overrides the preset")
+	krcvwnd = flags.Int("rcvwnd", 0, "receive window in segments, overrides the preset")
+	kmtu = flags.Int("mtu", kcp.KCP_MTU_DEF, "max size of udp packets")
+	kminrto = flags.Int("minrto", 0, "lower bound of rto in millisec")
+	kdeadlink = flags.Int("deadlink", kcp.KCP_DEADLINK, "a segment sent this many times marks the link dead")
+	kreadbuf = flags.Int("readbuf", 0, "receive buffer size of the udp socket in bytes")
+	kcc = flags.String("congestion", "reno", "congestion controller: reno or bbr")
+	ksack = flags.Bool("sack", false, "acknowledge with sack ranges, both sides should enable it")
+	kdata = flags.Int("datashard", 0, "fec data packets per group, 0 disables fec")
+	kparity = flags.Int("parityshard", 0, "fec parity packets per group, both sides should match")
+	kpacing = flags.Bool("pacing", false, "spread output at window per rtt instead of bursting every interval")
+	kbw = flags.Int("bandwidth", 0, "pacing rate cap in bytes per second, it enables pacing")
+	klinger = flags.Int("linger", kcp.KDP_LINGER, "millisec close waits for unacked data, negative closes at once")
+	kalive = flags.Int("keepalive", kcp.KDP_KEEPALIVE, "millisec without packets before a ping is sent, negative disables it")
+	kidle = flags.Int("idle", kcp.KDP_IDLE_TIMEOUT, "millisec without packets before the session fails, negative disables it")
+	ksndbuf = flags.Int("sendbuf", kcp.KDP_SEND_BUFFER, "bytes waiting to be sent or acked before writes block, negative means no limit")
+	ksndsegs = flags.Int("sendsegs", kcp.KDP_SEND_SEGMENTS, "segments waiting to be sent or acked before writes block, negative means no limit")
+	kkey = flags.String("key", "", "pre-shared secret, it encrypts every packet, both sides should match")
+	kcrypt = flags.String("crypt", "aes-gcm", "aead cipher: aes-gcm or chacha20-poly1305, needs a key or an identity")
+	kidentity = flags.String("identity", "", "file of the ed25519 key this side proves itself with, created when missing, it enables the key exchange")
+	kpeers = flags.String("known-peers", "", "file of the public keys of the peers allowed, one per line, needs an identity")
+}
+
+// KcpConfig builds the kcp session config from the mode preset and the
+// flags given on the command line.
+func KcpConfig(cmd *cobra.Command) (*kcp.Config, error) {
+	config, err := kcp.NewConfig(*kmode)
+	if err != nil {
+		return nil, err
+	}
+	overrides := map[string]func(){
+		"nodelay":     func() { config.NoDelay = *knodelay },
+		"interval":    func() { config.Interval = *kinterval },
+		"resend":      func() { config.Resend = *kresend },
+		"nc":          func() { config.NoCwnd = *knc },
+		"sndwnd":      func() { config.SndWnd = *ksndwnd },
+		"rcvwnd":      func() { config.RcvWnd = *krcvwnd },
+		"mtu":         func() { config.Mtu = *kmtu },
+		"minrto":      func() { config.MinRto = *kminrto },
+		"deadlink":    func() { config.DeadLink = *kdeadlink },
+		"readbuf":     func() { config.ReadBuffer = *kreadbuf },
+		"congestion":  func() { config.Congestion = *kcc },
+		"sack":        func() { config.Sack = *ksack },
+		"datashard":   func() { config.DataShards = *kdata },
+		"parityshard": func() { config.ParityShards = *kparity },
+		"pacing":      func() { config.Pacing = *kpacing },
+		"bandwidth":   func() { config.Bandwidth = *kbw },
+		"linger":      func() { config.Linger = *klinger },
+		"keepalive":   func() { config.KeepAlive = *kalive },
+		"idle":        func() { config.IdleTimeout = *kidle },
+		"sendbuf":     func() { config.SendBuffer = *ksndbuf },
+		"sendsegs":    func() { config.SendSegments = *ksndsegs },
+		"key":         func() { config.Key = *kkey },
+		"crypt":       func() { config.Crypt = *kcrypt },
+	}
+	for name, override := range overrides {
+		if cmd.Flags().Changed(name) {
+			override()
+		}
+	}
+	if *kidentity != "" {
+		if config.Identity, err = identity(*kidentity); err != nil {
+			return nil, err
+		}
+	}
+	if *kpeers != "" {
+		if config.KnownPeers, err = kcp.LoadKnownPeers(*kpeers); err != nil {
+			return nil, err
+		}
+	}
+	return config, config.Validate()
+}
+
+// identity loads the identity in path, a new one is written there when
+// the file doesn't exist yet.
+func identity(path string) (*kcp.Identity, error) {
+	if id, err := kcp.LoadIdentity(path); !os.IsNotExist(err) {
+		return id, err
+	}
+	id, err := kcp.NewIdentity()
+	if err != nil {
+		return nil, err
+	} else if err := id.Save(path); err != nil {
+		return nil, err
+	}
+	fmt.Printf("new identity saved to %s, public key %s\n", path, id.Public())
+	return id, nil
+}
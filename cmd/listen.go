@@ -44,6 +44,12 @@ func ExecuteListen(cmd *cobra.Command, args []string) {
 		cmd.Usage()
 		return
 	}
+	config, err := KcpConfig(cmd)
+	if err != nil {
+		fmt.Println(err)
+		cmd.Usage()
+		return
+	}
 	host := fmt.Sprintf("0.0.0.0:%d", *lport)
-	transfer.Serve(host, *ldest)
+	transfer.Serve(host, *ldest, config)
 }
@@ -49,6 +49,12 @@ func ExecuteReceive(cmd *cobra.Command, args []string) {
 		cmd.Usage()
 		return
 	}
+	config, err := KcpConfig(cmd)
+	if err != nil {
+		fmt.Println(err)
+		cmd.Usage()
+		return
+	}
 	raddr := fmt.Sprintf("%s:%d", *rhost, *rport)
-	transfer.RecvFile(*rname, *rdest, raddr)
+	transfer.RecvFile(*rname, *rdest, raddr, config)
 }
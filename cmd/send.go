@@ -46,6 +46,12 @@ func ExecuteSend(cmd *cobra.Command, args []string) {
 		cmd.Usage()
 		return
 	}
+	config, err := KcpConfig(cmd)
+	if err != nil {
+		fmt.Println(err)
+		cmd.Usage()
+		return
+	}
 	raddr := fmt.Sprintf("%s:%d", *shost, *sport)
-	transfer.SendFile(*sname, raddr)
+	transfer.SendFile(*sname, raddr, config)
 }
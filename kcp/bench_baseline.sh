@@ -0,0 +1,30 @@
+#!/bin/sh
+# bench_baseline.sh runs the benchmarks of bench_test.go at a baseline
+# revision and at the working tree, one after the other, so a change can
+# state both numbers. Run it from a checkout that builds, its go.mod and
+# go.sum are copied to the baseline.
+#   usage: kcp/bench_baseline.sh revision [go test flags]
+set -e
+if [ $# -eq 0 ]; then
+  echo "usage: $0 revision [go test flags]" >&2
+  exit 2
+fi
+base=$1
+shift
+root=$(git rev-parse --show-toplevel)
+tmp=$(mktemp -d)
+trap 'git -C "$root" worktree remove --force "$tmp/base"; rm -rf "$tmp"' EXIT
+
+git -C "$root" worktree add --detach "$tmp/base" "$base" > /dev/null
+for file in go.mod go.sum; do
+  if [ -f "$root/$file" ]; then
+    cp "$root/$file" "$tmp/base/$file"
+  fi
+done
+cp "$root/kcp/bench_test.go" "$tmp/base/kcp/bench_test.go"
+names=$(sed -n 's/^func \(Benchmark[A-Za-z0-9_]*\).*/\1/p' "$root/kcp/bench_test.go" | paste -sd '|' -)
+
+for tree in "$tmp/base" "$root"; do
+  echo "== $tree"
+  (cd "$tree" && go test -run '^$' -bench "^($names)\$" -benchmem -benchtime 20000x "$@" ./kcp)
+done
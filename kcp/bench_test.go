@@ -0,0 +1,54 @@
+package kcp
+
+import (
+  "strings"
+  "testing"
+)
+
+// bench_baseline.sh runs the benchmarks of this file at an older revision
+// as well, keep them to the api both have.
+
+// BenchmarkKDP sends messages from a client to a server session, msgs/s
+// and allocs/op show the cost of the session around the kcp engine.
+// 1000 byte messages over loopback, 20000x:
+//   command channel per session   4638 msgs/s  5716 B/op  46 allocs/op
+//   mutex guarded session         8435 msgs/s  2610 B/op  12 allocs/op
+func BenchmarkKDP(b *testing.B) {
+  server, err := Listen("0.0.0.0:9010", nil)
+  if err != nil {
+    b.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+  config := DefaultConfig()
+  config.Linger = -1
+  client, err := Dial("127.0.0.1:9010", config)
+  if err != nil {
+    b.Fatalf("dial server failed %v", err)
+  }
+  defer client.Close()
+  sock, err := server.AcceptKDP()
+  if err != nil {
+    b.Fatalf("accept failed %v", err)
+  }
+  
+  msg := []byte(strings.Repeat("m", 1000))
+  done := make(chan bool)
+  b.ReportAllocs()
+  b.ResetTimer()
+  go func() {
+    buffer := make([]byte, 2000)
+    for i := 0; i < b.N; i++ {
+      if _, err := sock.Read(buffer); err != nil {
+        break
+      }
+    }
+    done <- true
+  }()
+  for i := 0; i < b.N; i++ {
+    if _, err := client.Write(msg); err != nil {
+      b.Fatalf("write failed %v", err)
+    }
+  }
+  <- done
+  b.ReportMetric(float64(b.N) / b.Elapsed().Seconds(), "msgs/s")
+}
@@ -0,0 +1,217 @@
+package kcp
+
+import (
+  "fmt"
+  "time"
+  "errors"
+)
+
+const (
+  KCP_MTU_MAX = 1500
+  KDP_LINGER = 10000
+  KDP_KEEPALIVE = 10000
+  KDP_IDLE_TIMEOUT = 30000
+  KDP_SEND_BUFFER = 4 << 20
+  KDP_SEND_SEGMENTS = 4096
+)
+
+// Config holds the per session settings used by Dial and Listen, a zero
+// value field keeps the protocal default.
+type Config struct {
+  NoDelay  int  `desc:"1 enables nodelay mode, rto grows slower"`
+  Interval int  `desc:"internal flush interval in millisec"`
+  Resend   int  `desc:"fast resend after this many out of order acks, 0 disables it"`
+  NoCwnd   int  `desc:"1 disables congestion control"`
+  SndWnd   int  `desc:"send window in segments"`
+  RcvWnd   int  `desc:"receive window in segments"`
+  Mtu      int  `desc:"max size of udp packets"`
+  MinRto   int  `desc:"lower bound of rto in millisec"`
+  DeadLink int  `desc:"a segment sent this many times marks the link dead"`
+  ReadBuffer int `desc:"receive buffer size of the udp socket in bytes"`
+  Stream   bool `desc:"stream mode, writes are not bounded by the fragment limit"`
+  Congestion string `desc:"congestion controller: reno or bbr, defaults to reno, naming one enables it over nocwnd"`
+  Sack     bool `desc:"acknowledge with sack ranges, both sides should enable it"`
+  DataShards   int `desc:"fec data packets per group, 0 disables fec"`
+  ParityShards int `desc:"fec parity packets per group, both sides should match"`
+  Pacing   bool `desc:"spread output at window per rtt instead of bursting every interval"`
+  Bandwidth int `desc:"pacing rate cap in bytes per second, it enables pacing"`
+  Linger   int  `desc:"millisec Close waits for unacked data and FIN-ACK, negative closes at once"`
+  KeepAlive int `desc:"millisec without packets before a ping is sent, negative disables it"`
+  IdleTimeout int `desc:"millisec without packets before the session fails, negative disables it"`
+  SendBuffer int `desc:"bytes waiting to be sent or acked before Write blocks, negative means no limit"`
+  SendSegments int `desc:"segments waiting to be sent or acked before Write blocks, negative means no limit"`
+  Key      string `desc:"pre-shared secret, it enables encryption of every packet, both sides should match"`
+  Crypt    string `desc:"aead cipher: aes-gcm or chacha20-poly1305, defaults to aes-gcm"`
+  Identity *Identity `desc:"long-term key the peer proves itself with, it enables the key exchange, both sides should have one"`
+  KnownPeers KnownPeers `desc:"public keys of the peers allowed to connect, nil allows any"`
+  // sessions start with sequence numbers and clock shifted by these,
+  // tests move them close to 2^32 to exercise wraparound
+  sn_offset, clock_offset uint32
+}
+
+var presets = map[string]Config {
+  "normal": {NoDelay: 0, Interval: 40, Resend: 0, NoCwnd: 0, SndWnd: 32, RcvWnd: 32},
+  "fast":   {NoDelay: 0, Interval: 20, Resend: 2, NoCwnd: 1, SndWnd: 128, RcvWnd: 128},
+  "turbo":  {NoDelay: 1, Interval: 10, Resend: 2, NoCwnd: 1, SndWnd: 256, RcvWnd: 256},
+}
+
+// DefaultConfig returns the settings used when Dial or Listen is given a nil config.
+func DefaultConfig() *Config {
+  config, _ := NewConfig("turbo")
+  return config
+}
+
+// NewConfig returns a copy of the named preset: normal, fast or turbo.
+func NewConfig(mode string) (*Config, error) {
+  preset, ok := presets[mode]
+  if !ok {
+    return nil, fmt.Errorf("unknown kcp mode %s", mode)
+  }
+  config := preset
+  config.Mtu = KCP_MTU_DEF
+  config.DeadLink = KCP_DEADLINK
+  config.Linger = KDP_LINGER
+  config.KeepAlive = KDP_KEEPALIVE
+  config.IdleTimeout = KDP_IDLE_TIMEOUT
+  config.SendBuffer = KDP_SEND_BUFFER
+  config.SendSegments = KDP_SEND_SEGMENTS
+  return &config, nil
+}
+
+// Validate checks the config before it's applied to a session.
+func (config *Config) Validate() error {
+  if config.NoDelay < 0 || config.NoDelay > 1 {
+    return errors.New("nodelay should be 0 or 1")
+  } else if config.NoCwnd < 0 || config.NoCwnd > 1 {
+    return errors.New("nc should be 0 or 1")
+  } else if config.Interval < 0 || config.Resend < 0 || config.MinRto < 0 {
+    return errors.New("interval, resend and minrto should not be negative")
+  } else if config.SndWnd < 0 || config.DeadLink < 0 || config.ReadBuffer < 0 {
+    return errors.New("sndwnd, deadlink and readbuf should not be negative")
+  } else if config.Bandwidth < 0 {
+    return errors.New("bandwidth should not be negative")
+  } else if config.RcvWnd != 0 && config.RcvWnd < KCP_WND_RCV {
+    // a message may take KCP_WND_RCV - 1 fragments, it must fit in the window
+    return fmt.Errorf("rcvwnd should not be less than %d", KCP_WND_RCV)
+  } else if config.Mtu != 0 && (config.Mtu < 50 || config.Mtu > KCP_MTU_MAX) {
+    return fmt.Errorf("mtu should be in range [50, %d]", KCP_MTU_MAX)
+  } else if config.DataShards < 0 || config.ParityShards < 0 {
+    return errors.New("datashard and parityshard should not be negative")
+  } else if (config.DataShards == 0) != (config.ParityShards == 0) {
+    return errors.New("datashard and parityshard should be both set or both 0")
+  } else if config.DataShards + config.ParityShards > 256 {
+    return errors.New("datashard plus parityshard should not exceed 256")
+  } else if config.idle() > 0 && config.idle() <= config.keepalive() {
+    return errors.New("idle timeout should be longer than keepalive")
+  } else if _, err := NewCongestionController(config.Congestion); err != nil {
+    return err
+  } else if config.Crypt != "" && config.Key == "" && config.Identity == nil {
+    return errors.New("crypt needs a key or an identity")
+  } else if config.KnownPeers != nil && config.Identity == nil {
+    return errors.New("known peers need an identity")
+  } else if _, err := new_aead(config.Crypt, make([]byte, CRYPT_KEY)); err != nil {
+    return err
+  }
+  return nil
+}
+
+func (config *Config) apply(kcp *KCP) {
+  interval := config.Interval
+  if interval == 0 {
+    interval = -1
+  }
+  nocwnd := config.NoCwnd
+  if config.Congestion != "" {
+    // a chosen controller would do nothing with the window disabled
+    nocwnd = 0
+  }
+  kcp.SetNoDelay(config.NoDelay, interval, config.Resend, nocwnd)
+  kcp.WndSize(config.SndWnd, config.RcvWnd)
+  mtu := config.Mtu
+  if mtu == 0 {
+    mtu = KCP_MTU_DEF
+  }
+  if config.fec() {
+    // fec header and size are appended to every kcp packet
+    mtu -= FEC_OVERHEAD
+  }
+  if config.Key != "" || config.Identity != nil {
+    mtu -= CRYPT_OVERHEAD
+  }
+  kcp.SetMtu(mtu)
+  kcp.reset_sn(config.sn_offset)
+  if config.MinRto > 0 {
+    kcp.SetMinRto(config.MinRto)
+  }
+  if config.DeadLink > 0 {
+    kcp.SetDeadLink(config.DeadLink)
+  }
+  kcp.SetKeepAlive(config.keepalive())
+  kcp.SetStream(config.Stream)
+  kcp.SetSack(config.Sack)
+  if cc, err := NewCongestionController(config.Congestion); err == nil {
+    kcp.SetCongestion(cc)
+  }
+}
+
+func (config *Config) fec() bool {
+  return config.DataShards > 0 && config.ParityShards > 0
+}
+
+// crypt returns the Crypt of the key for the client or server side, nil
+// without one
+func (config *Config) crypt(client bool) (*Crypt, error) {
+  if config.Key == "" {
+    return nil, nil
+  }
+  return NewCrypt(config.Crypt, config.Key, client)
+}
+
+func (config *Config) pacing() bool {
+  return config.Pacing || config.Bandwidth > 0
+}
+
+func (config *Config) linger() time.Duration {
+  if config.Linger == 0 {
+    return KDP_LINGER * time.Millisecond
+  } else if config.Linger < 0 {
+    return 0
+  }
+  return time.Duration(config.Linger) * time.Millisecond
+}
+
+// keepalive interval in millisec, 0 when disabled
+func (config *Config) keepalive() int {
+  if config.KeepAlive == 0 {
+    return KDP_KEEPALIVE
+  } else if config.KeepAlive < 0 {
+    return 0
+  }
+  return config.KeepAlive
+}
+
+// idle timeout in millisec, 0 when disabled
+func (config *Config) idle() int {
+  if config.IdleTimeout == 0 {
+    return KDP_IDLE_TIMEOUT
+  } else if config.IdleTimeout < 0 {
+    return 0
+  }
+  return config.IdleTimeout
+}
+
+// send buffer limits in bytes and segments, 0 when unlimited
+func (config *Config) send_limit() (int, int) {
+  bytes, segs := config.SendBuffer, config.SendSegments
+  if bytes == 0 {
+    bytes = KDP_SEND_BUFFER
+  } else if bytes < 0 {
+    bytes = 0
+  }
+  if segs == 0 {
+    segs = KDP_SEND_SEGMENTS
+  } else if segs < 0 {
+    segs = 0
+  }
+  return bytes, segs
+}
@@ -0,0 +1,55 @@
+package kcp
+
+import (
+  "testing"
+)
+
+func TestPresets(t *testing.T) {
+  for _, mode := range []string{"normal", "fast", "turbo"} {
+    config, err := NewConfig(mode)
+    if err != nil {
+      t.Fatalf("preset %s not found", mode)
+    } else if err := config.Validate(); err != nil {
+      t.Errorf("preset %s invalid %v", mode, err)
+    }
+    config.SndWnd = 1
+    if preset, _ := NewConfig(mode); preset.SndWnd == 1 {
+      t.Errorf("preset %s modified through a copy", mode)
+    }
+  }
+  if _, err := NewConfig("unknown"); err == nil {
+    t.Errorf("unknown mode accepted")
+  }
+}
+
+func TestConfigApply(t *testing.T) {
+  config := &Config{NoDelay: 1, Interval: 20, Resend: 2, NoCwnd: 1, SndWnd: 64, 
+    RcvWnd: 128, Mtu: 500, MinRto: 50, DeadLink: 20}
+  if err := config.Validate(); err != nil {
+    t.Fatalf("config invalid %v", err)
+  }
+  kcp := NewKCP(1, nil)
+  config.apply(kcp)
+  if kcp.nodelay != 1 || kcp.interval != 20 || kcp.faskresend != 2 || kcp.nocwnd != 1 {
+    t.Errorf("nodelay not applied")
+  } else if kcp.snd_wnd != 64 || kcp.rcv_wnd != 128 {
+    t.Errorf("window not applied %d/%d", kcp.snd_wnd, kcp.rcv_wnd)
+  } else if kcp.mtu != 500 || kcp.mss != 500 - KCP_OVERHEAD {
+    t.Errorf("mtu not applied %d", kcp.mtu)
+  } else if kcp.rx_minrto != 50 || kcp.dead_link != 20 {
+    t.Errorf("minrto or deadlink not applied %d/%d", kcp.rx_minrto, kcp.dead_link)
+  }
+  
+  kcp = NewKCP(1, nil)
+  new(Config).apply(kcp)
+  if kcp.interval != KCP_INTERVAL || kcp.mtu != KCP_MTU_DEF || kcp.snd_wnd != KCP_WND_SND {
+    t.Errorf("zero config changed defaults")
+  }
+  
+  bad := []Config{{NoDelay: 2}, {RcvWnd: 8}, {Mtu: 9000}, {Interval: -1}}
+  for _, config := range bad {
+    if config.Validate() == nil {
+      t.Errorf("bad config accepted %+v", config)
+    }
+  }
+}
@@ -0,0 +1,296 @@
+package kcp
+
+import (
+  "fmt"
+)
+
+const (
+  KCP_BBR_MIN_CWND = 4
+  KCP_BBR_BW_ROUNDS = 10
+  KCP_BBR_RTT_EXPIRE = 10000
+  KCP_BBR_PROBE_RTT = 200
+  KCP_BBR_HIGH_GAIN = 2.885
+)
+
+const (
+  BBR_STARTUP = iota
+  BBR_DRAIN
+  BBR_PROBE_BW
+  BBR_PROBE_RTT
+)
+
+var bbr_cycle = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// CongestionState is what the protocal knows about the session when it
+// reports an event to a CongestionController.
+type CongestionState struct {
+  Mss      uint32 `desc:"max segment size in bytes"`
+  Inflight uint32 `desc:"segments sent but not acked yet"`
+  SndWnd   uint32 `desc:"local send window in segments"`
+  RmtWnd   uint32 `desc:"receive window of remote side in segments"`
+  Resend   uint32 `desc:"fast resend threshold, 0 when disabled"`
+  Srtt     uint32 `desc:"smoothed rtt in millisec"`
+  Current  uint32 `desc:"current timestamp in millisec"`
+}
+
+// CongestionController decides how many segments may be in flight, and
+// how fast they should be sent out.
+type CongestionController interface {
+  // OnAck is called when acked segments left snd_buf, rtt is the latest
+  // sample taken from the acks, 0 if there is none.
+  OnAck(state *CongestionState, acked, rtt uint32)
+  // OnLoss is called when segments are fast resent.
+  OnLoss(state *CongestionState)
+  // OnTimeout is called when segments are resent after rto.
+  OnTimeout(state *CongestionState)
+  // Cwnd returns the congestion window in segments.
+  Cwnd() uint32
+  // PacingRate returns the send rate in bytes per second, 0 means the
+  // controller has no opinion.
+  PacingRate() uint32
+}
+
+// NewCongestionController creates a controller by name: reno or bbr.
+func NewCongestionController(name string) (CongestionController, error) {
+  switch name {
+  case "", "reno":
+    return NewReno(), nil
+  case "bbr":
+    return NewBBR(), nil
+  default:
+    return nil, fmt.Errorf("unknown congestion controller %s", name)
+  }
+}
+
+// Reno is the default controller, it's the algorithm of the reference
+// ikcp: slow start, congestion avoidance, and window reduction on loss.
+type Reno struct {
+  cwnd, ssthresh, incr uint32
+}
+
+func NewReno() *Reno {
+  reno := new(Reno)
+  reno.cwnd, reno.ssthresh = 1, KCP_THRESH_INIT
+  return reno
+}
+
+// Ssthresh returns the slow start threshold in segments.
+func (reno *Reno) Ssthresh() uint32 {
+  return reno.ssthresh
+}
+
+func (reno *Reno) OnAck(state *CongestionState, acked, rtt uint32) {
+  if reno.cwnd >= state.RmtWnd {
+    return
+  }
+  mss := state.Mss
+  if reno.cwnd < reno.ssthresh {
+    reno.cwnd++
+    reno.incr += mss
+  } else {
+    if reno.incr < mss {
+      reno.incr = mss
+    }
+    reno.incr += mss * mss / reno.incr + mss / 16
+    if (reno.cwnd + 1) * mss <= reno.incr {
+      reno.cwnd++
+    }
+  }
+  if reno.cwnd > state.RmtWnd {
+    reno.cwnd = state.RmtWnd
+    reno.incr = mss * state.RmtWnd
+  }
+}
+
+func (reno *Reno) OnLoss(state *CongestionState) {
+  reno.ssthresh = max(state.Inflight / 2, KCP_THRESH_MIN)
+  reno.cwnd = reno.ssthresh + state.Resend
+  reno.incr = reno.cwnd * state.Mss
+  reno.floor(state)
+}
+
+func (reno *Reno) OnTimeout(state *CongestionState) {
+  cwnd := min(reno.cwnd, min(state.SndWnd, state.RmtWnd))
+  reno.ssthresh = max(cwnd / 2, KCP_THRESH_MIN)
+  reno.cwnd = 1
+  reno.incr = state.Mss
+}
+
+func (reno *Reno) floor(state *CongestionState) {
+  if reno.cwnd < 1 {
+    reno.cwnd = 1
+    reno.incr = state.Mss
+  }
+}
+
+func (reno *Reno) Cwnd() uint32 {
+  return reno.cwnd
+}
+
+func (reno *Reno) PacingRate() uint32 {
+  return 0
+}
+
+// BBR is a model based controller in the style of tcp bbr. It estimates
+// the bottleneck bandwidth and the min rtt of the path, and sizes cwnd
+// and pacing rate by their product instead of backing off on every loss,
+// which suits long and lossy links.
+type BBR struct {
+  mode int
+  cwnd uint32
+  delivered uint32
+  round_start, round_delivered uint32
+  bw_samples [KCP_BBR_BW_ROUNDS]uint32
+  rounds uint32
+  btlbw uint32
+  min_rtt, min_rtt_ts uint32
+  full_bw, full_bw_cnt uint32
+  filled bool
+  cycle_idx int
+  cycle_ts uint32
+  probe_rtt_done uint32
+  pacing_gain, cwnd_gain float64
+}
+
+func NewBBR() *BBR {
+  bbr := new(BBR)
+  bbr.cwnd = KCP_BBR_MIN_CWND
+  bbr.enter(BBR_STARTUP, 0)
+  return bbr
+}
+
+func (bbr *BBR) enter(mode int, current uint32) {
+  bbr.mode = mode
+  switch mode {
+  case BBR_STARTUP:
+    bbr.pacing_gain, bbr.cwnd_gain = KCP_BBR_HIGH_GAIN, KCP_BBR_HIGH_GAIN
+  case BBR_DRAIN:
+    // kcp sends a whole cwnd in one flush, the queue built in startup
+    // only drains if cwnd shrinks to the bdp as well
+    bbr.pacing_gain, bbr.cwnd_gain = 1 / KCP_BBR_HIGH_GAIN, 1
+  case BBR_PROBE_BW:
+    bbr.cycle_idx, bbr.cycle_ts = 0, current
+    bbr.pacing_gain, bbr.cwnd_gain = bbr_cycle[0], 2
+  case BBR_PROBE_RTT:
+    bbr.pacing_gain, bbr.cwnd_gain = 1, 1
+    bbr.probe_rtt_done = current + max(KCP_BBR_PROBE_RTT, bbr.min_rtt)
+  }
+}
+
+// bandwidth delay product in bytes
+func (bbr *BBR) bdp() uint32 {
+  return uint32(uint64(bbr.btlbw) * uint64(bbr.min_rtt) / 1000)
+}
+
+func (bbr *BBR) OnAck(state *CongestionState, acked, rtt uint32) {
+  current := state.Current
+  bbr.delivered += acked * state.Mss
+  expired := bbr.min_rtt > 0 && timediff(current, bbr.min_rtt_ts) > KCP_BBR_RTT_EXPIRE
+  if rtt > 0 && (bbr.min_rtt == 0 || rtt <= bbr.min_rtt || expired) {
+    bbr.min_rtt, bbr.min_rtt_ts = rtt, current
+  }
+  
+  round := max(bbr.min_rtt, 1)
+  if bbr.rounds == 0 && bbr.round_start == 0 {
+    bbr.round_start, bbr.round_delivered = current, bbr.delivered - acked * state.Mss
+  }
+  if elapsed := timediff(current, bbr.round_start); elapsed >= int(round) {
+    bbr.end_round(uint32(elapsed), current)
+  }
+  bbr.update_mode(state, expired)
+  
+  target := uint32(bbr.cwnd_gain * float64(bbr.bdp()) / float64(state.Mss))
+  if !bbr.filled || bbr.cwnd < target {
+    bbr.cwnd += acked
+  }
+  if bbr.filled && bbr.cwnd > target {
+    bbr.cwnd = target
+  }
+  bbr.cwnd = max(bbr.cwnd, KCP_BBR_MIN_CWND)
+}
+
+// a round trip passed, sample the delivery rate of it
+func (bbr *BBR) end_round(elapsed, current uint32) {
+  rate := uint32(uint64(bbr.delivered - bbr.round_delivered) * 1000 / uint64(elapsed))
+  bbr.bw_samples[bbr.rounds % KCP_BBR_BW_ROUNDS] = rate
+  bbr.rounds++
+  bbr.round_start, bbr.round_delivered = current, bbr.delivered
+  
+  bbr.btlbw = 0
+  for _, sample := range bbr.bw_samples {
+    bbr.btlbw = max(bbr.btlbw, sample)
+  }
+  
+  // the pipe is filled when bandwidth stops growing for 3 rounds
+  if bbr.filled {
+    return
+  } else if bbr.btlbw >= bbr.full_bw + bbr.full_bw / 4 {
+    bbr.full_bw, bbr.full_bw_cnt = bbr.btlbw, 0
+  } else if bbr.full_bw_cnt++; bbr.full_bw_cnt >= 3 {
+    bbr.filled = true
+  }
+}
+
+func (bbr *BBR) update_mode(state *CongestionState, expired bool) {
+  current := state.Current
+  switch bbr.mode {
+  case BBR_STARTUP:
+    if bbr.filled {
+      bbr.enter(BBR_DRAIN, current)
+    }
+  case BBR_DRAIN:
+    if state.Inflight * state.Mss <= bbr.bdp() {
+      bbr.enter(BBR_PROBE_BW, current)
+    }
+  case BBR_PROBE_BW:
+    if timediff(current, bbr.cycle_ts) >= int(bbr.min_rtt) {
+      bbr.cycle_idx = (bbr.cycle_idx + 1) % len(bbr_cycle)
+      bbr.cycle_ts = current
+      bbr.pacing_gain = bbr_cycle[bbr.cycle_idx]
+    }
+  case BBR_PROBE_RTT:
+    if timediff(current, bbr.probe_rtt_done) >= 0 {
+      bbr.min_rtt_ts = current
+      if bbr.filled {
+        bbr.enter(BBR_PROBE_BW, current)
+      } else {
+        bbr.enter(BBR_STARTUP, current)
+      }
+    }
+  }
+  
+  // min rtt not refreshed for a long time, drain the queue to measure it
+  if bbr.mode != BBR_PROBE_RTT && expired {
+    bbr.enter(BBR_PROBE_RTT, current)
+  }
+}
+
+// bbr keeps its model on loss, random loss on the link does not mean
+// the bottleneck is congested.
+func (bbr *BBR) OnLoss(state *CongestionState) {
+}
+
+// a timeout means the model no longer fits the path, bbr drops it and
+// probes again from startup with the least window.
+func (bbr *BBR) OnTimeout(state *CongestionState) {
+  bbr.cwnd = KCP_BBR_MIN_CWND
+  bbr.bw_samples, bbr.btlbw = [KCP_BBR_BW_ROUNDS]uint32{}, 0
+  bbr.full_bw, bbr.full_bw_cnt, bbr.filled = 0, 0, false
+  bbr.round_start, bbr.round_delivered = state.Current, bbr.delivered
+  bbr.enter(BBR_STARTUP, state.Current)
+}
+
+func (bbr *BBR) Cwnd() uint32 {
+  if bbr.mode == BBR_PROBE_RTT {
+    return KCP_BBR_MIN_CWND
+  }
+  return bbr.cwnd
+}
+
+func (bbr *BBR) PacingRate() uint32 {
+  rate := bbr.pacing_gain * float64(bbr.btlbw)
+  if rate > 0xffffffff {
+    return 0xffffffff
+  }
+  return uint32(rate)
+}
@@ -0,0 +1,152 @@
+package kcp
+
+import (
+  "testing"
+)
+
+func TestReno(t *testing.T) {
+  reno := NewReno()
+  state := &CongestionState{Mss: 1000, SndWnd: 32, RmtWnd: 32, Resend: 2}
+  reno.OnAck(state, 1, 50)
+  if reno.Cwnd() != 2 {
+    t.Errorf("slow start not grow cwnd %d", reno.Cwnd())
+  }
+  for i := 0; i < 1000; i++ {
+    reno.OnAck(state, 1, 50)
+  }
+  if reno.Cwnd() != state.RmtWnd {
+    t.Errorf("cwnd not bounded by remote window %d", reno.Cwnd())
+  }
+  
+  state.Inflight = 20
+  reno.OnLoss(state)
+  if reno.Cwnd() != 20 / 2 + state.Resend || reno.ssthresh != 10 {
+    t.Errorf("fast resend cwnd not match %d/%d", reno.Cwnd(), reno.ssthresh)
+  }
+  reno.OnTimeout(state)
+  if reno.Cwnd() != 1 || reno.ssthresh != 6 {
+    t.Errorf("timeout cwnd not match %d/%d", reno.Cwnd(), reno.ssthresh)
+  }
+  if reno.PacingRate() != 0 {
+    t.Errorf("reno should not pace")
+  }
+}
+
+func TestBBR(t *testing.T) {
+  bbr := NewBBR()
+  state := &CongestionState{Mss: 1000, SndWnd: 1024, RmtWnd: 1024}
+  
+  // a path of 1MB/s and 50ms rtt, 10 segments acked every 10ms
+  for state.Current = 10; state.Current < 3000; state.Current += 10 {
+    state.Inflight = bbr.Cwnd()
+    bbr.OnAck(state, 10, 50)
+    if state.Current % 500 == 0 {
+      bbr.OnLoss(state)
+    }
+  }
+  if bbr.mode != BBR_PROBE_BW {
+    t.Errorf("bbr not in probe bw mode %d", bbr.mode)
+  } else if bbr.btlbw < 900000 || bbr.btlbw > 1100000 {
+    t.Errorf("bandwidth estimate not match %d", bbr.btlbw)
+  } else if bbr.min_rtt != 50 {
+    t.Errorf("min rtt not match %d", bbr.min_rtt)
+  } else if bbr.Cwnd() < 80 || bbr.Cwnd() > 120 {
+    t.Errorf("cwnd not sized by bdp %d", bbr.Cwnd())
+  } else if rate := bbr.PacingRate(); rate < 700000 || rate > 1300000 {
+    t.Errorf("pacing rate not match %d", rate)
+  }
+  
+  // min rtt expired, probe it with a small window
+  for end := state.Current + KCP_BBR_RTT_EXPIRE + 100; state.Current < end; state.Current += 10 {
+    bbr.OnAck(state, 10, 80)
+  }
+  if bbr.mode != BBR_PROBE_RTT || bbr.Cwnd() != KCP_BBR_MIN_CWND {
+    t.Errorf("bbr not probing rtt %d/%d", bbr.mode, bbr.Cwnd())
+  }
+  for end := state.Current + 2 * KCP_BBR_PROBE_RTT; state.Current < end; state.Current += 10 {
+    bbr.OnAck(state, 10, 60)
+  }
+  if bbr.mode != BBR_PROBE_BW || bbr.min_rtt != 60 {
+    t.Errorf("bbr not back to probe bw %d/%d", bbr.mode, bbr.min_rtt)
+  }
+}
+
+func TestBBRTimeout(t *testing.T) {
+  bbr := NewBBR()
+  state := &CongestionState{Mss: 1000, SndWnd: 1024, RmtWnd: 1024}
+  for state.Current = 10; state.Current < 3000; state.Current += 10 {
+    state.Inflight = bbr.Cwnd()
+    bbr.OnAck(state, 10, 50)
+  }
+  if bbr.mode != BBR_PROBE_BW {
+    t.Fatalf("bbr not in probe bw mode %d", bbr.mode)
+  }
+  // the model is dropped, the path is probed again
+  bbr.OnTimeout(state)
+  if bbr.mode != BBR_STARTUP || bbr.Cwnd() != KCP_BBR_MIN_CWND || bbr.filled || bbr.btlbw != 0 {
+    t.Errorf("bbr kept its model after timeout %d/%d", bbr.mode, bbr.Cwnd())
+  }
+  for end := state.Current + 3000; state.Current < end; state.Current += 10 {
+    state.Inflight = bbr.Cwnd()
+    bbr.OnAck(state, 10, 50)
+  }
+  if bbr.mode != BBR_PROBE_BW || bbr.btlbw < 900000 || bbr.btlbw > 1100000 {
+    t.Errorf("bbr not back to probe bw %d/%d", bbr.mode, bbr.btlbw)
+  }
+  
+  // the gain of a fast path doesn't wrap the rate
+  bbr.btlbw, bbr.pacing_gain = 0xf0000000, KCP_BBR_HIGH_GAIN
+  if rate := bbr.PacingRate(); rate != 0xffffffff {
+    t.Errorf("pacing rate wraps to %d", rate)
+  }
+}
+
+func TestBBRSession(t *testing.T) {
+  c2s, s2c := &Loopback{drop: 4}, new(Loopback)
+  ckcp, skcp := NewKCP(7, c2s.Write), NewKCP(7, s2c.Write)
+  for _, kcp := range []*KCP{ckcp, skcp} {
+    kcp.SetNoDelay(1, 10, 2, 0)
+    kcp.WndSize(256, 256)
+    kcp.SetStream(true)
+    kcp.SetCongestion(NewBBR())
+  }
+  
+  sent := make([]byte, 512 * 1024)
+  ckcp.Send(sent)
+  var current uint32
+  recved, buffer := 0, make([]byte, 4096)
+  for i := 0; i < 5000 && recved < len(sent); i++ {
+    current += 10
+    ckcp.Update(current)
+    skcp.Update(current)
+    c2s.deliver(skcp)
+    s2c.deliver(ckcp)
+    for {
+      cnt, err := skcp.Recv(buffer)
+      if err != nil {
+        break
+      }
+      recved += cnt
+    }
+  }
+  if recved != len(sent) {
+    t.Errorf("bbr session lost data %d/%d", recved, len(sent))
+  }
+}
+
+func TestBBRWindow(t *testing.T) {
+  // the presets disable the window, naming a controller turns it back on
+  config := DefaultConfig()
+  config.Congestion = "bbr"
+  lo := new(Loopback)
+  kcp := NewKCP(7, lo.Write)
+  config.apply(kcp)
+  for i := 0; i < 64; i++ {
+    kcp.Send(make([]byte, kcp.mss))
+  }
+  kcp.Update(10)
+  kcp.Update(20)
+  if inflight := kcp.snd_nxt - kcp.snd_una; inflight != KCP_BBR_MIN_CWND {
+    t.Errorf("bbr window not applied, %d segments in flight", inflight)
+  }
+}
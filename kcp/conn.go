@@ -0,0 +1,123 @@
+package kcp
+
+import (
+  "net"
+  "sync"
+  "time"
+)
+
+var (
+  _ net.Conn = (*KDP)(nil)
+  _ net.Conn = (*Client)(nil)
+  _ net.Listener = (*Server)(nil)
+)
+
+// deadline holds the read and write deadlines of a session, they are set
+// from any goroutine so a lock guards them.
+type deadline struct {
+  lock sync.Mutex
+  rd, wd time.Time
+  rd_wake, wd_wake chan bool
+}
+
+func (dl *deadline) init() {
+  dl.rd_wake = make(chan bool, 1)
+  dl.wd_wake = make(chan bool, 1)
+}
+
+func (dl *deadline) SetReadDeadline(t time.Time) error {
+  dl.lock.Lock()
+  dl.rd = t
+  dl.lock.Unlock()
+  // a pending Read should see the new deadline
+  select {
+  case dl.rd_wake <- true:
+  default:
+  }
+  return nil
+}
+
+func (dl *deadline) SetWriteDeadline(t time.Time) error {
+  dl.lock.Lock()
+  dl.wd = t
+  dl.lock.Unlock()
+  // so does a Write blocked on the send buffer
+  select {
+  case dl.wd_wake <- true:
+  default:
+  }
+  return nil
+}
+
+func (dl *deadline) SetDeadline(t time.Time) error {
+  dl.SetWriteDeadline(t)
+  return dl.SetReadDeadline(t)
+}
+
+func expired(t time.Time) bool {
+  return !t.IsZero() && !time.Now().Before(t)
+}
+
+func (dl *deadline) read_expired() bool {
+  dl.lock.Lock()
+  defer dl.lock.Unlock()
+  return expired(dl.rd)
+}
+
+func (dl *deadline) write_expired() bool {
+  dl.lock.Lock()
+  defer dl.lock.Unlock()
+  return expired(dl.wd)
+}
+
+// read_timer fires at the read deadline, it's nil when there is none
+func (dl *deadline) read_timer() *time.Timer {
+  dl.lock.Lock()
+  defer dl.lock.Unlock()
+  return timer_at(dl.rd)
+}
+
+func (dl *deadline) write_timer() *time.Timer {
+  dl.lock.Lock()
+  defer dl.lock.Unlock()
+  return timer_at(dl.wd)
+}
+
+func timer_at(t time.Time) *time.Timer {
+  if t.IsZero() {
+    return nil
+  }
+  return time.NewTimer(time.Until(t))
+}
+
+func (k *KDP) LocalAddr() net.Addr {
+  return k.udp.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer, a Server session moves
+// along with its client.
+func (k *KDP) RemoteAddr() net.Addr {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  return k.raddr
+}
+
+func (client *Client) LocalAddr() net.Addr {
+  return client.udp.LocalAddr()
+}
+
+func (client *Client) RemoteAddr() net.Addr {
+  return client.pipe.raddr
+}
+
+func (client *Client) SetDeadline(t time.Time) error {
+  return client.pipe.SetDeadline(t)
+}
+
+func (client *Client) SetReadDeadline(t time.Time) error {
+  return client.pipe.SetReadDeadline(t)
+}
+
+func (client *Client) SetWriteDeadline(t time.Time) error {
+  return client.pipe.SetWriteDeadline(t)
+}
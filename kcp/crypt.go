@@ -0,0 +1,126 @@
+package kcp
+
+import (
+  "fmt"
+  "errors"
+  "sync/atomic"
+  "crypto/aes"
+  "crypto/rand"
+  "crypto/cipher"
+  "crypto/sha256"
+  "encoding/binary"
+)
+
+import (
+  "golang.org/x/crypto/pbkdf2"
+  "golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+  CRYPT_CONV = 4
+  CRYPT_NONCE = 12
+  CRYPT_SEQ = 8
+  CRYPT_TAG = 16
+  CRYPT_OVERHEAD = CRYPT_CONV + CRYPT_NONCE + CRYPT_SEQ + CRYPT_TAG
+  CRYPT_KEY = 32
+  CRYPT_ITER = 4096
+)
+
+var (
+  ErrAuth = errors.New("packet authentication failed")
+  crypt_salt = []byte("kcp_tran crypt")
+)
+
+// Crypt seals every datagram with an aead cipher, a sealed packet is the
+// conv in clear and a random nonce followed by the encrypted seq and data,
+// and their tag, which covers the conv too. The conv finds the session
+// before its keys are known, the seq counts the packets of a session for
+// the anti-replay filter. Handshake packets have conv and seq 0. It's safe for
+// concurrent use, so the sessions of a Server share one. A nil Crypt
+// leaves packets in plaintext. Each direction has its own key, a packet
+// reflected back to its sender never opens.
+type Crypt struct {
+  seal, open cipher.AEAD
+}
+
+// NewCrypt derives the keys of cipher name from a pre-shared secret, one
+// for each direction, client tells the side that dials. Name is aes-gcm
+// or chacha20-poly1305, empty means aes-gcm.
+func NewCrypt(name, secret string, client bool) (*Crypt, error) {
+  keys := pbkdf2.Key([]byte(secret), crypt_salt, CRYPT_ITER, 2 * CRYPT_KEY, sha256.New)
+  c2s, s2c := keys[:CRYPT_KEY], keys[CRYPT_KEY:]
+  if client {
+    return new_crypt(name, c2s, s2c)
+  }
+  return new_crypt(name, s2c, c2s)
+}
+
+// new_crypt seals with the send key and opens with the recv one.
+func new_crypt(name string, send, recv []byte) (*Crypt, error) {
+  seal, err := new_aead(name, send)
+  if err != nil {
+    return nil, err
+  }
+  open, err := new_aead(name, recv)
+  if err != nil {
+    return nil, err
+  }
+  return &Crypt{seal: seal, open: open}, nil
+}
+
+func new_aead(name string, key []byte) (cipher.AEAD, error) {
+  switch name {
+  case "", "aes-gcm":
+    block, err := aes.NewCipher(key)
+    if err != nil {
+      return nil, err
+    }
+    return cipher.NewGCM(block)
+  case "chacha20-poly1305":
+    return chacha20poly1305.New(key)
+  default:
+    return nil, fmt.Errorf("unknown cipher %s", name)
+  }
+}
+
+// Seal returns pkt and its seq encrypted under a fresh nonce, for the
+// session conv.
+func (crypt *Crypt) Seal(pkt []byte, conv uint32, seq uint64) []byte {
+  if crypt == nil {
+    return pkt
+  }
+  plain := make([]byte, CRYPT_SEQ + len(pkt))
+  binary.LittleEndian.PutUint64(plain, seq)
+  copy(plain[CRYPT_SEQ:], pkt)
+  rslt := make([]byte, CRYPT_CONV + CRYPT_NONCE, CRYPT_OVERHEAD + len(pkt))
+  binary.LittleEndian.PutUint32(rslt, conv)
+  rand.Read(rslt[CRYPT_CONV:])
+  return crypt.seal.Seal(rslt, rslt[CRYPT_CONV:], plain, rslt[:CRYPT_CONV])
+}
+
+// Open checks and decrypts pkt in place, it returns the seq and data and
+// fails with ErrAuth when pkt was forged or altered. A nil Crypt returns
+// seq 0.
+func (crypt *Crypt) Open(pkt []byte) (uint64, []byte, error) {
+  if crypt == nil {
+    return 0, pkt, nil
+  } else if len(pkt) < CRYPT_OVERHEAD {
+    atomic.AddUint64(&DefaultSnmp.AuthErrs, 1)
+    return 0, nil, ErrAuth
+  }
+  head := CRYPT_CONV + CRYPT_NONCE
+  plain, err := crypt.open.Open(pkt[head:head], pkt[CRYPT_CONV:head], pkt[head:], pkt[:CRYPT_CONV])
+  if err != nil {
+    atomic.AddUint64(&DefaultSnmp.AuthErrs, 1)
+    return 0, nil, ErrAuth
+  }
+  return binary.LittleEndian.Uint64(plain), plain[CRYPT_SEQ:], nil
+}
+
+// sealed_conv returns the conv of a sealed packet, before it's opened.
+func sealed_conv(pkt []byte) uint32 {
+  if len(pkt) < CRYPT_OVERHEAD {
+    return 0
+  }
+  return binary.LittleEndian.Uint32(pkt)
+}
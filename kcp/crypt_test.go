@@ -0,0 +1,61 @@
+package kcp
+
+import (
+  "bytes"
+  "testing"
+)
+
+func TestCrypt(t *testing.T) {
+  msg := []byte("kcp packet")
+  for _, name := range []string{"aes-gcm", "chacha20-poly1305"} {
+    client, err := NewCrypt(name, "secret", true)
+    if err != nil {
+      t.Fatalf("%s: create failed %v", name, err)
+    }
+    crypt, _ := NewCrypt(name, "secret", false)
+    sealed := client.Seal(msg, 3, 7)
+    if len(sealed) != len(msg) + CRYPT_OVERHEAD || bytes.Contains(sealed, msg) {
+      t.Errorf("%s: sealed packet %x", name, sealed)
+    }
+    if other := client.Seal(msg, 3, 7); bytes.Equal(other, sealed) {
+      t.Errorf("%s: nonce reused", name)
+    }
+    if seq, data, err := crypt.Open(append([]byte(nil), sealed...)); err != nil || seq != 7 || !bytes.Equal(data, msg) {
+      t.Errorf("%s: open returns %d %q %v", name, seq, data, err)
+    }
+    // a packet sent back to its sender doesn't pass for one of the peer
+    if _, _, err := client.Open(append([]byte(nil), sealed...)); err != ErrAuth {
+      t.Errorf("%s: reflected packet opens with %v", name, err)
+    }
+
+    tampered := append([]byte(nil), sealed...)
+    tampered[CRYPT_NONCE] ^= 1
+    if _, _, err := crypt.Open(tampered); err != ErrAuth {
+      t.Errorf("%s: tampered packet opens with %v", name, err)
+    }
+    // the conv is in clear but covered by the tag
+    if conv := sealed_conv(sealed); conv != 3 {
+      t.Errorf("%s: sealed conv %d", name, conv)
+    }
+    moved := append([]byte(nil), sealed...)
+    moved[0]++
+    if _, _, err := crypt.Open(moved); err != ErrAuth {
+      t.Errorf("%s: packet with changed conv opens with %v", name, err)
+    }
+    if _, _, err := crypt.Open(sealed[:CRYPT_OVERHEAD - 1]); err != ErrAuth {
+      t.Errorf("%s: short packet opens with %v", name, err)
+    }
+    wrong, _ := NewCrypt(name, "guess", false)
+    if _, _, err := wrong.Open(append([]byte(nil), sealed...)); err != ErrAuth {
+      t.Errorf("%s: wrong key opens with %v", name, err)
+    }
+  }
+
+  var plain *Crypt
+  if _, data, err := plain.Open(plain.Seal(msg, 3, 7)); err != nil || !bytes.Equal(data, msg) {
+    t.Errorf("nil crypt changes packets %q %v", data, err)
+  }
+  if _, err := NewCrypt("rot13", "secret", true); err == nil {
+    t.Errorf("unknown cipher accepted")
+  }
+}
@@ -0,0 +1,134 @@
+package kcp
+
+import (
+  "io"
+  "errors"
+  "sync/atomic"
+  "crypto/ecdh"
+  "crypto/rand"
+  "crypto/cipher"
+  "crypto/sha256"
+  "crypto/ed25519"
+  "encoding/binary"
+)
+
+import (
+  "golang.org/x/crypto/hkdf"
+  "golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+  KX_PUBLIC = 32
+  // identity and its signature, sealed under the handshake key
+  KX_PROOF = ed25519.PublicKeySize + ed25519.SignatureSize + CRYPT_TAG
+  KX_SERVER = 1
+  KX_CLIENT = 2
+)
+
+var (
+  ErrPeerRefused = errors.New("peer identity refused")
+  kx_label = []byte("kcp_tran exchange")
+)
+
+// exchange is one side of the key exchange carried by the handshake, in
+// the way of noise XX:
+//   client SYN     ephemeral key
+//   server SYN-ACK ephemeral key, server proof
+//   client SYN-ACK client proof
+// A proof is the ed25519 identity and its signature of the transcript
+// hash, sealed under a key from the dh of both ephemeral keys, so the
+// identities aren't visible on the path. Traffic keys come from the same
+// dh, they can't be recovered once the ephemeral keys are gone.
+type exchange struct {
+  eph *ecdh.PrivateKey
+  hash []byte
+  hs cipher.AEAD
+  c2s, s2c []byte
+}
+
+func new_exchange() (*exchange, error) {
+  eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+  if err != nil {
+    return nil, err
+  }
+  return &exchange{eph: eph}, nil
+}
+
+func (ex *exchange) public() []byte {
+  return ex.eph.PublicKey().Bytes()
+}
+
+// derive mixes the dh with peer, the ephemeral key of the other side,
+// and the transcript of the handshake into the keys.
+func (ex *exchange) derive(peer []byte, conv, cnonce, snonce uint32, cpub, spub []byte) error {
+  key, err := ecdh.X25519().NewPublicKey(peer)
+  if err != nil {
+    return err
+  }
+  shared, err := ex.eph.ECDH(key)
+  if err != nil {
+    return err
+  }
+  h := sha256.New()
+  h.Write(kx_label)
+  binary.Write(h, binary.LittleEndian, []uint32{conv, cnonce, snonce})
+  h.Write(cpub)
+  h.Write(spub)
+  ex.hash = h.Sum(nil)
+
+  keys := make([]byte, 3 * CRYPT_KEY)
+  if _, err := io.ReadFull(hkdf.New(sha256.New, shared, ex.hash, kx_label), keys); err != nil {
+    return err
+  }
+  if ex.hs, err = chacha20poly1305.New(keys[:CRYPT_KEY]); err != nil {
+    return err
+  }
+  ex.c2s, ex.s2c = keys[CRYPT_KEY:2 * CRYPT_KEY], keys[2 * CRYPT_KEY:]
+  return nil
+}
+
+// prove returns the proof of id, role tells which side signs it.
+func (ex *exchange) prove(id *Identity, role byte) []byte {
+  plain := make([]byte, 0, ed25519.PublicKeySize + ed25519.SignatureSize)
+  plain = append(plain, id.key.Public().(ed25519.PublicKey)...)
+  plain = append(plain, ed25519.Sign(id.key, ex.signed(role))...)
+  return ex.hs.Seal(nil, ex.nonce(role), plain, nil)
+}
+
+// verify checks the proof of the other side, its identity should be one
+// of peers.
+func (ex *exchange) verify(proof []byte, role byte, peers KnownPeers) error {
+  plain, err := ex.hs.Open(nil, ex.nonce(role), proof, nil)
+  if err != nil || len(plain) != ed25519.PublicKeySize + ed25519.SignatureSize {
+    atomic.AddUint64(&DefaultSnmp.AuthErrs, 1)
+    return ErrAuth
+  }
+  key := ed25519.PublicKey(plain[:ed25519.PublicKeySize])
+  if !ed25519.Verify(key, ex.signed(role), plain[ed25519.PublicKeySize:]) {
+    atomic.AddUint64(&DefaultSnmp.AuthErrs, 1)
+    return ErrAuth
+  } else if !peers.allow(key) {
+    atomic.AddUint64(&DefaultSnmp.PeerRefused, 1)
+    return ErrPeerRefused
+  }
+  return nil
+}
+
+// crypt returns the traffic keys of the session, cipher is name.
+func (ex *exchange) crypt(name string, role byte) (*Crypt, error) {
+  if role == KX_CLIENT {
+    return new_crypt(name, ex.c2s, ex.s2c)
+  }
+  return new_crypt(name, ex.s2c, ex.c2s)
+}
+
+func (ex *exchange) signed(role byte) []byte {
+  return append([]byte{role}, ex.hash...)
+}
+
+// each handshake key seals one proof per side
+func (ex *exchange) nonce(role byte) []byte {
+  nonce := make([]byte, chacha20poly1305.NonceSize)
+  nonce[0] = role
+  return nonce
+}
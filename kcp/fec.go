@@ -0,0 +1,234 @@
+package kcp
+
+import (
+  "errors"
+  "sync/atomic"
+  "encoding/binary"
+)
+
+import (
+  "github.com/klauspost/reedsolomon"
+)
+
+const (
+  FEC_HEADER = 6
+  FEC_SIZE = 2
+  FEC_OVERHEAD = FEC_HEADER + FEC_SIZE
+  FEC_TYPE_DATA = 0xf1
+  FEC_TYPE_PARITY = 0xf2
+  FEC_MAX_GROUPS = 64
+)
+
+// FecEncoder adds reed-solomon parity packets after every data shards
+// count of kcp packets. Every packet gets a header of seqid(4) and
+// flag(2), data packets also carry their size(2) so they can be
+// restored from zero padded shards.
+type FecEncoder struct {
+  codec reedsolomon.Encoder
+  data, parity, shards int
+  seqid, paws uint32
+  cache [][]byte
+  cnt, maxlen int
+}
+
+func NewFecEncoder(data, parity int) (*FecEncoder, error) {
+  enc := new(FecEncoder)
+  if err := enc.init(data, parity); err != nil {
+    return nil, err
+  }
+  return enc, nil
+}
+
+func (enc *FecEncoder) init(data, parity int) error {
+  codec, err := reedsolomon.New(data, parity)
+  if err != nil {
+    return err
+  }
+  enc.codec = codec
+  enc.data, enc.parity, enc.shards = data, parity, data + parity
+  enc.paws = 0xffffffff / uint32(enc.shards) * uint32(enc.shards)
+  enc.cache = make([][]byte, enc.data)
+  return nil
+}
+
+func (enc *FecEncoder) header(buffer []byte, flag uint16) {
+  binary.LittleEndian.PutUint32(buffer, enc.seqid)
+  binary.LittleEndian.PutUint16(buffer[4:], flag)
+  enc.seqid = (enc.seqid + 1) % enc.paws
+}
+
+// Encode wraps pkt as a data packet, when a group of data packets is
+// complete the parity packets are returned after it.
+func (enc *FecEncoder) Encode(pkt []byte) [][]byte {
+  buffer := make([]byte, FEC_OVERHEAD + len(pkt))
+  enc.header(buffer, FEC_TYPE_DATA)
+  binary.LittleEndian.PutUint16(buffer[FEC_HEADER:], uint16(FEC_SIZE + len(pkt)))
+  copy(buffer[FEC_OVERHEAD:], pkt)
+  rslt := [][]byte{buffer}
+  
+  enc.cache[enc.cnt] = buffer[FEC_HEADER:]
+  if size := len(buffer) - FEC_HEADER; size > enc.maxlen {
+    enc.maxlen = size
+  }
+  enc.cnt++
+  if enc.cnt < enc.data {
+    return rslt
+  }
+  
+  shards := make([][]byte, enc.shards)
+  for i := 0; i < enc.shards; i++ {
+    shards[i] = make([]byte, enc.maxlen)
+    if i < enc.data {
+      copy(shards[i], enc.cache[i])
+    }
+  }
+  if err := enc.codec.Encode(shards); err == nil {
+    for _, shard := range shards[enc.data:] {
+      buffer := make([]byte, FEC_HEADER + len(shard))
+      enc.header(buffer, FEC_TYPE_PARITY)
+      copy(buffer[FEC_HEADER:], shard)
+      rslt = append(rslt, buffer)
+    }
+  } else {
+    // keep groups aligned with seqid even if parity is skipped
+    enc.seqid = (enc.seqid + uint32(enc.parity)) % enc.paws
+  }
+  enc.cnt, enc.maxlen = 0, 0
+  return rslt
+}
+
+type fec_group struct {
+  shards [][]byte
+  cnt int
+  done bool
+}
+
+// FecDecoder strips fec headers, and restores lost data packets of a
+// group once enough data and parity packets of it have arrived.
+type FecDecoder struct {
+  codec reedsolomon.Encoder
+  data, parity, shards int
+  groups map[uint32]*fec_group
+  order []uint32
+}
+
+func NewFecDecoder(data, parity int) (*FecDecoder, error) {
+  dec := new(FecDecoder)
+  if err := dec.init(data, parity); err != nil {
+    return nil, err
+  }
+  return dec, nil
+}
+
+func (dec *FecDecoder) init(data, parity int) error {
+  codec, err := reedsolomon.New(data, parity)
+  if err != nil {
+    return err
+  }
+  dec.codec = codec
+  dec.data, dec.parity, dec.shards = data, parity, data + parity
+  dec.groups = make(map[uint32]*fec_group)
+  return nil
+}
+
+// Decode returns the kcp packets carried by pkt, which is the packet
+// itself for a data packet, plus the data packets restored with it.
+func (dec *FecDecoder) Decode(pkt []byte) ([][]byte, error) {
+  if len(pkt) < FEC_OVERHEAD {
+    return nil, errors.New("fec packet too small")
+  }
+  seqid := binary.LittleEndian.Uint32(pkt)
+  flag := binary.LittleEndian.Uint16(pkt[4:])
+  shard := pkt[FEC_HEADER:]
+  
+  var rslt [][]byte
+  switch flag {
+  case FEC_TYPE_DATA:
+    if data, err := shard_data(shard); err != nil {
+      return nil, err
+    } else {
+      rslt = append(rslt, data)
+    }
+  case FEC_TYPE_PARITY:
+  default:
+    return nil, errors.New("unknown fec packet type")
+  }
+  
+  group := dec.group(seqid / uint32(dec.shards))
+  idx := int(seqid % uint32(dec.shards))
+  if group.done || group.shards[idx] != nil {
+    return rslt, nil
+  }
+  group.shards[idx] = shard
+  group.cnt++
+  if group.cnt < dec.data {
+    return rslt, nil
+  }
+  
+  group.done = true
+  recovered := dec.reconstruct(group)
+  group.shards = nil
+  return append(rslt, recovered...), nil
+}
+
+func (dec *FecDecoder) group(id uint32) *fec_group {
+  if group, ok := dec.groups[id]; ok {
+    return group
+  }
+  group := new(fec_group)
+  group.shards = make([][]byte, dec.shards)
+  dec.groups[id] = group
+  dec.order = append(dec.order, id)
+  if len(dec.order) > FEC_MAX_GROUPS {
+    delete(dec.groups, dec.order[0])
+    dec.order = dec.order[1:]
+  }
+  return group
+}
+
+func (dec *FecDecoder) reconstruct(group *fec_group) [][]byte {
+  var missing []int
+  maxlen := 0
+  for i, shard := range group.shards {
+    if shard == nil && i < dec.data {
+      missing = append(missing, i)
+    } else if len(shard) > maxlen {
+      maxlen = len(shard)
+    }
+  }
+  if len(missing) == 0 {
+    return nil
+  }
+  
+  shards := make([][]byte, dec.shards)
+  for i, shard := range group.shards {
+    if shard != nil {
+      shards[i] = make([]byte, maxlen)
+      copy(shards[i], shard)
+    }
+  }
+  if err := dec.codec.ReconstructData(shards); err != nil {
+    return nil
+  }
+  
+  var rslt [][]byte
+  for _, i := range missing {
+    if data, err := shard_data(shards[i]); err == nil {
+      rslt = append(rslt, data)
+    }
+  }
+  atomic.AddUint64(&DefaultSnmp.FecRecovered, uint64(len(rslt)))
+  return rslt
+}
+
+// kcp packet in a data shard, it may be followed by zero padding
+func shard_data(shard []byte) ([]byte, error) {
+  if len(shard) < FEC_SIZE {
+    return nil, errors.New("fec shard too small")
+  }
+  size := int(binary.LittleEndian.Uint16(shard))
+  if size < FEC_SIZE || size > len(shard) {
+    return nil, errors.New("fec shard size not match")
+  }
+  return shard[FEC_SIZE:size], nil
+}
@@ -0,0 +1,69 @@
+package kcp
+
+import (
+  "bytes"
+  "testing"
+  "math/rand"
+)
+
+func TestFecRecover(t *testing.T) {
+  enc, err := NewFecEncoder(4, 2)
+  if err != nil {
+    t.Fatalf("create encoder failed %v", err)
+  }
+  dec, _ := NewFecDecoder(4, 2)
+  
+  var sent, recv [][]byte
+  for i := 0; i < 40; i++ {
+    data := make([]byte, 20 + rand.Intn(200))
+    rand.Read(data)
+    sent = append(sent, data)
+    for j, pkt := range enc.Encode(data) {
+      // every group loses its second data packet and one parity packet
+      if i % 4 == 1 && j == 0 || i % 4 == 3 && j == 1 {
+        continue
+      }
+      pkts, err := dec.Decode(pkt)
+      if err != nil {
+        t.Fatalf("decode failed %v", err)
+      }
+      recv = append(recv, pkts...)
+    }
+  }
+  
+  if len(recv) != len(sent) {
+    t.Fatalf("%d packets recovered, %d sent", len(recv), len(sent))
+  }
+  for _, data := range sent {
+    found := false
+    for _, pkt := range recv {
+      found = found || bytes.Equal(data, pkt)
+    }
+    if !found {
+      t.Fatalf("packet lost")
+    }
+  }
+}
+
+func TestFecSession(t *testing.T) {
+  config := &Config{DataShards: 3, ParityShards: 1}
+  if err := config.Validate(); err != nil {
+    t.Fatalf("config invalid %v", err)
+  }
+  kcp := NewKCP(1, nil)
+  config.apply(kcp)
+  if kcp.mtu != KCP_MTU_DEF - FEC_OVERHEAD {
+    t.Errorf("mtu not reduced for fec header %d", kcp.mtu)
+  }
+  config.ParityShards = 0
+  if err := config.Validate(); err == nil {
+    t.Errorf("parity shards should be required with data shards")
+  }
+  dec, err := NewFecDecoder(4, 2)
+  if err != nil {
+    t.Fatalf("create decoder failed %v", err)
+  }
+  if _, err := dec.Decode([]byte{1, 2, 3}); err == nil {
+    t.Errorf("short packet accepted")
+  }
+}
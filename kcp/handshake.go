@@ -0,0 +1,363 @@
+package kcp
+
+import (
+  "net"
+  "context"
+  "time"
+  "errors"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/binary"
+)
+
+const (
+  KDP_HANDSHAKE_RESEND = 200 * time.Millisecond
+  KDP_HANDSHAKE_TIMEOUT = 5 * time.Second
+  KDP_PENDING_MAX = 1024
+  // issue time and truncated hmac
+  KDP_COOKIE_SIZE = 4 + 16
+  KDP_COOKIE_LIFE = 2 * KDP_HANDSHAKE_TIMEOUT
+  // handshake packets start with a zero conv(4) and this flag(2)
+  KDP_HANDSHAKE_HEADER = 6
+  KDP_HANDSHAKE_FLAG = 0xf0
+)
+
+var (
+  ErrHandshakeTimeout = errors.New("kcp handshake timeout")
+)
+
+// A session is set up in three steps, all of them bare segments outside
+// of fec and the arq behind a handshake header:
+//   client SYN     conv 0, sn client nonce, data cookie
+//   server SYN-ACK conv assigned by server, sn server nonce, una client nonce
+//   client SYN-ACK conv, sn client nonce, una server nonce
+// The server keeps only a half open record until the last step arrives
+// from the same address, and the session is accepted after it. Until then
+// it repeats its SYN-ACK every KDP_HANDSHAKE_RESEND, the last step may be
+// lost and the client has nothing else to send for a while. With an
+// Identity the steps carry the key exchange as their data after the
+// cookie, see exchange.
+//
+// The first SYN has a zero cookie, the server answers it without keeping
+// any state:
+//   server COOKIE  conv 0, una client nonce, data cookie
+// The cookie is an hmac of the client address, nonce and issue time, so
+// spoofed sources never get past it. The SYN is at least as long as the
+// COOKIE, the server can't amplify a flood.
+//
+// The header tells handshake packets from session ones before fec or kcp
+// look at them. A kcp packet starts with its conv, which is never 0, and
+// a fec packet has a seqid and a flag other than KDP_HANDSHAKE_FLAG.
+type half_open struct {
+  conv, nonce, snonce uint32
+  synack []byte
+  ex *exchange
+  raddr *net.UDPAddr
+  expire, resend time.Time
+}
+
+// random non zero number for conv and nonces
+func rand_uint32() uint32 {
+  buffer := make([]byte, 4)
+  for {
+    rand.Read(buffer)
+    if rslt := binary.LittleEndian.Uint32(buffer); rslt != 0 {
+      return rslt
+    }
+  }
+}
+
+func handshake_packet(conv, cmd, sn, una uint32) []byte {
+  return kx_packet(conv, cmd, sn, una, nil)
+}
+
+// kx_packet is a handshake step carrying data of the key exchange.
+func kx_packet(conv, cmd, sn, una uint32, data []byte) []byte {
+  seg := new(Segment)
+  seg.conv, seg.cmd, seg.sn, seg.una = conv, cmd, sn, una
+  seg.ts = clock()
+  seg.data = data
+  buffer := make([]byte, KDP_HANDSHAKE_HEADER + KCP_OVERHEAD + len(data))
+  binary.LittleEndian.PutUint16(buffer[4:], KDP_HANDSHAKE_FLAG)
+  seg.Encode(buffer[KDP_HANDSHAKE_HEADER:])
+  return buffer
+}
+
+// is_handshake reports whether data starts with the handshake header.
+func is_handshake(data []byte) bool {
+  return len(data) >= KDP_HANDSHAKE_HEADER && binary.LittleEndian.Uint32(data) == 0 && 
+    binary.LittleEndian.Uint16(data[4:]) == KDP_HANDSHAKE_FLAG
+}
+
+// parse_handshake returns the segment in data if it's a handshake one.
+func parse_handshake(data []byte) *Segment {
+  if !is_handshake(data) {
+    return nil
+  }
+  data = data[KDP_HANDSHAKE_HEADER:]
+  if len(data) < KCP_OVERHEAD || len(data) > KCP_OVERHEAD + KX_PUBLIC + KX_PROOF {
+    return nil
+  }
+  seg, rest, err := Decode(data)
+  if err != nil || len(rest) != 0 {
+    return nil
+  } else if seg.cmd != KCP_CMD_SYN && seg.cmd != KCP_CMD_SYNACK && seg.cmd != KCP_CMD_COOKIE {
+    return nil
+  }
+  return seg
+}
+
+// client_handshake sends SYN until the server answers, it returns the
+// assigned conv and the last step, which is sent again whenever the
+// server repeats its SYN-ACK. Packets are sealed with crypt, which may be
+// nil. The session is sealed with the returned Crypt, the traffic keys
+// when config has an Identity, crypt otherwise.
+func client_handshake(ctx context.Context, conn *net.UDPConn, raddr *net.UDPAddr, crypt *Crypt, config *Config) (uint32, []byte, *Crypt, error) {
+  nonce := rand_uint32()
+  var ex *exchange
+  var pub []byte
+  if config.Identity != nil {
+    var err error
+    if ex, err = new_exchange(); err != nil {
+      return 0, nil, nil, err
+    }
+    pub = ex.public()
+  }
+  syn_packet := func(cookie []byte) []byte {
+    return kx_packet(0, KCP_CMD_SYN, nonce, 0, append(cookie, pub...))
+  }
+  syn := syn_packet(make([]byte, KDP_COOKIE_SIZE))
+  buffer := make([]byte, KCP_MTU_MAX)
+  deadline := time.Now().Add(KDP_HANDSHAKE_TIMEOUT)
+  until, bound := ctx.Deadline()
+  if bound = bound && until.Before(deadline); bound {
+    deadline = until
+  }
+  // cancel wakes the pending read
+  stop := context.AfterFunc(ctx, func() {
+    conn.SetReadDeadline(time.Now())
+  })
+  defer stop()
+  for time.Now().Before(deadline) && ctx.Err() == nil {
+    if _, err := conn.WriteToUDP(crypt.Seal(syn, 0, 0), raddr); err != nil {
+      return 0, nil, nil, err
+    }
+    resend := time.Now().Add(KDP_HANDSHAKE_RESEND)
+    if resend.After(deadline) {
+      resend = deadline
+    }
+    conn.SetReadDeadline(resend)
+    if ctx.Err() != nil {
+      break
+    }
+    for {
+      cnt, from, err := conn.ReadFromUDP(buffer)
+      if err != nil {
+        break
+      } else if from.String() != raddr.String() {
+        continue
+      }
+      _, pkt, err := crypt.Open(buffer[:cnt])
+      if err != nil {
+        continue
+      }
+      seg := parse_handshake(pkt)
+      if seg != nil && seg.cmd == KCP_CMD_COOKIE && seg.una == nonce && len(seg.data) == KDP_COOKIE_SIZE {
+        syn = syn_packet(append([]byte(nil), seg.data...))
+        if _, err := conn.WriteToUDP(crypt.Seal(syn, 0, 0), raddr); err != nil {
+          return 0, nil, nil, err
+        }
+        continue
+      } else if seg == nil || seg.cmd != KCP_CMD_SYNACK || seg.una != nonce || seg.conv == 0 {
+        continue
+      }
+      session, ack := crypt, handshake_packet(seg.conv, KCP_CMD_SYNACK, nonce, seg.sn)
+      if ex != nil {
+        if session, err = client_exchange(ex, seg, nonce, config); err == ErrPeerRefused {
+          conn.SetReadDeadline(time.Time{})
+          return 0, nil, nil, err
+        } else if err != nil {
+          // forged or from a server without identity
+          continue
+        }
+        ack = kx_packet(seg.conv, KCP_CMD_SYNACK, nonce, seg.sn, ex.prove(config.Identity, KX_CLIENT))
+      }
+      conn.SetReadDeadline(time.Time{})
+      _, err = conn.WriteToUDP(crypt.Seal(ack, 0, 0), raddr)
+      return seg.conv, ack, session, err
+    }
+  }
+  conn.SetReadDeadline(time.Time{})
+  if err := ctx.Err(); err != nil {
+    return 0, nil, nil, err
+  } else if bound {
+    return 0, nil, nil, context.DeadlineExceeded
+  }
+  return 0, nil, nil, ErrHandshakeTimeout
+}
+
+// client_exchange checks the proof of the server in its SYN-ACK, and
+// returns the traffic keys.
+func client_exchange(ex *exchange, seg *Segment, nonce uint32, config *Config) (*Crypt, error) {
+  if len(seg.data) != KX_PUBLIC + KX_PROOF {
+    return nil, ErrAuth
+  }
+  spub := seg.data[:KX_PUBLIC]
+  if err := ex.derive(spub, seg.conv, nonce, seg.sn, ex.public(), spub); err != nil {
+    return nil, err
+  } else if err := ex.verify(seg.data[KX_PUBLIC:], KX_SERVER, config.KnownPeers); err != nil {
+    return nil, err
+  }
+  return ex.crypt(config.Crypt, KX_CLIENT)
+}
+
+// handshake deals with a packet from an address without session, it
+// returns the session once the handshake completes.
+func (server *Server) handshake(data []byte, raddr *net.UDPAddr) *KDP {
+  key := raddr.String()
+  half, ok := server.pending[key]
+  if ok && time.Now().After(half.expire) {
+    delete(server.pending, key)
+    half, ok = nil, false
+  }
+  
+  // anything else, session packets before the last step as well, gets
+  // no answer, the SYN-ACK is repeated on its own timer only
+  seg := parse_handshake(data)
+  switch {
+  case seg == nil:
+  case seg.cmd == KCP_CMD_SYN && seg.conv == 0:
+    if len(seg.data) < KDP_COOKIE_SIZE {
+      return nil
+    } else if !server.check_cookie(seg.data[:KDP_COOKIE_SIZE], raddr, seg.sn) {
+      cookie := server.cookie(raddr, seg.sn, uint32(time.Now().Unix()))
+      server.udp.WriteToUDP(server.crypt.Seal(kx_packet(0, KCP_CMD_COOKIE, 0, seg.sn, cookie), 0, 0), raddr)
+      return nil
+    }
+    seg.data = seg.data[KDP_COOKIE_SIZE:]
+    if !ok || half.nonce != seg.sn {
+      if half = server.half_open(seg); half == nil {
+        return nil
+      }
+      half.raddr = raddr
+      server.pending[key] = half
+    }
+    server.send_synack(half)
+  case seg.cmd == KCP_CMD_SYNACK && ok && seg.conv == half.conv && seg.una == half.snonce:
+    crypt := server.crypt
+    if half.ex != nil {
+      if err := half.ex.verify(seg.data, KX_CLIENT, server.config.KnownPeers); err == ErrPeerRefused {
+        delete(server.pending, key)
+        return nil
+      } else if err != nil {
+        return nil
+      }
+      // the cipher is checked by Validate
+      crypt, _ = half.ex.crypt(server.config.Crypt, KX_SERVER)
+    }
+    delete(server.pending, key)
+    return server.new_session(half.conv, raddr, crypt)
+  }
+  return nil
+}
+
+func (server *Server) half_open(syn *Segment) *half_open {
+  now := time.Now()
+  if len(server.pending) >= KDP_PENDING_MAX {
+    for key, half := range server.pending {
+      if now.After(half.expire) {
+        delete(server.pending, key)
+      }
+    }
+  }
+  if len(server.pending) >= KDP_PENDING_MAX {
+    return nil
+  }
+  
+  half := new(half_open)
+  half.nonce, half.snonce = syn.sn, rand_uint32()
+  for half.conv = rand_uint32(); server.conv_used(half.conv); {
+    half.conv = rand_uint32()
+  }
+  if id := server.config.Identity; id == nil {
+    if len(syn.data) != 0 {
+      return nil
+    }
+    half.synack = handshake_packet(half.conv, KCP_CMD_SYNACK, half.snonce, half.nonce)
+  } else if len(syn.data) != KX_PUBLIC {
+    return nil
+  } else if ex, err := new_exchange(); err != nil {
+    return nil
+  } else if err := ex.derive(syn.data, half.conv, half.nonce, half.snonce, syn.data, ex.public()); err != nil {
+    return nil
+  } else {
+    half.ex = ex
+    proof := append(ex.public(), ex.prove(id, KX_SERVER)...)
+    half.synack = kx_packet(half.conv, KCP_CMD_SYNACK, half.snonce, half.nonce, proof)
+  }
+  half.expire = now.Add(KDP_HANDSHAKE_TIMEOUT)
+  return half
+}
+
+// send_synack sends the SYN-ACK of half, and sends it again after
+// KDP_HANDSHAKE_RESEND unless the last step arrives.
+func (server *Server) send_synack(half *half_open) {
+  server.udp.WriteToUDP(server.crypt.Seal(half.synack, 0, 0), half.raddr)
+  half.resend = time.Now().Add(KDP_HANDSHAKE_RESEND)
+  if server.resend.IsZero() || half.resend.Before(server.resend) {
+    server.resend = half.resend
+  }
+}
+
+// resend_synacks repeats the SYN-ACKs due, and drops the expired records.
+func (server *Server) resend_synacks() {
+  now := time.Now()
+  if server.resend.IsZero() || now.Before(server.resend) {
+    return
+  }
+  server.resend = time.Time{}
+  for key, half := range server.pending {
+    if now.After(half.expire) {
+      delete(server.pending, key)
+    } else if now.Before(half.resend) {
+      if server.resend.IsZero() || half.resend.Before(server.resend) {
+        server.resend = half.resend
+      }
+    } else {
+      server.send_synack(half)
+    }
+  }
+}
+
+// cookie returns the cookie of a client nonce from raddr issued at ts,
+// in unix seconds.
+func (server *Server) cookie(raddr *net.UDPAddr, nonce, ts uint32) []byte {
+  mac := hmac.New(sha256.New, server.secret)
+  binary.Write(mac, binary.LittleEndian, []uint32{ts, nonce, uint32(raddr.Port)})
+  mac.Write(raddr.IP.To16())
+  rslt := make([]byte, KDP_COOKIE_SIZE)
+  binary.LittleEndian.PutUint32(rslt, ts)
+  copy(rslt[4:], mac.Sum(nil))
+  return rslt
+}
+
+func (server *Server) check_cookie(cookie []byte, raddr *net.UDPAddr, nonce uint32) bool {
+  ts := binary.LittleEndian.Uint32(cookie)
+  if age := uint32(time.Now().Unix()) - ts; ts == 0 || age > uint32(KDP_COOKIE_LIFE / time.Second) {
+    return false
+  }
+  return hmac.Equal(cookie, server.cookie(raddr, nonce, ts))
+}
+
+func (server *Server) conv_used(conv uint32) bool {
+  if _, ok := server.pipes[conv]; ok {
+    return true
+  }
+  for _, half := range server.pending {
+    if half.conv == conv {
+      return true
+    }
+  }
+  return false
+}
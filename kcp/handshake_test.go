@@ -0,0 +1,237 @@
+package kcp
+
+import (
+  "net"
+  "time"
+  "context"
+  "testing"
+)
+
+func TestHandshake(t *testing.T) {
+  server, err := Listen("0.0.0.0:9010", nil)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+  raddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:9010")
+  conn, err := net.DialUDP("udp4", nil, raddr)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  defer conn.Close()
+  
+  // stray packets and a session packet with a guessed conv
+  push := make([]byte, KCP_OVERHEAD + 4)
+  seg := &Segment{conv: 1, cmd: KCP_CMD_PUSH, data: []byte{1, 2, 3, 4}}
+  seg.Encode(push)
+  conn.Write([]byte("hello"))
+  conn.Write(push)
+  
+  // a SYN without cookie, or too short to carry one, gets no state
+  buffer := make([]byte, 2048)
+  conn.SetReadDeadline(time.Now().Add(time.Second))
+  conn.Write(handshake_packet(0, KCP_CMD_SYN, 77, 0))
+  conn.Write(kx_packet(0, KCP_CMD_SYN, 77, 0, make([]byte, KDP_COOKIE_SIZE)))
+  cnt, err := conn.Read(buffer)
+  if err != nil {
+    t.Fatalf("no cookie %v", err)
+  }
+  cookie := parse_handshake(buffer[:cnt])
+  if cookie == nil || cookie.cmd != KCP_CMD_COOKIE || cookie.una != 77 || len(cookie.data) != KDP_COOKIE_SIZE {
+    t.Fatalf("bad cookie %v", cookie)
+  } else if cnt > KDP_HANDSHAKE_HEADER + KCP_OVERHEAD + KDP_COOKIE_SIZE {
+    t.Errorf("cookie of %d bytes is longer than the SYN", cnt)
+  }
+  cookie.data = append([]byte(nil), cookie.data...)
+  // the cookie is bound to the nonce
+  conn.Write(kx_packet(0, KCP_CMD_SYN, 78, 0, cookie.data))
+  if cnt, err = conn.Read(buffer); err != nil || parse_handshake(buffer[:cnt]).cmd != KCP_CMD_COOKIE {
+    t.Fatalf("cookie of another nonce accepted %v", err)
+  }
+  
+  conn.Write(kx_packet(0, KCP_CMD_SYN, 77, 0, cookie.data))
+  if cnt, err = conn.Read(buffer); err != nil {
+    t.Fatalf("no syn-ack %v", err)
+  }
+  synack := parse_handshake(buffer[:cnt])
+  if synack == nil || synack.cmd != KCP_CMD_SYNACK || synack.una != 77 || synack.conv == 0 {
+    t.Fatalf("bad syn-ack %v", synack)
+  }
+  // the last step is lost, the server repeats its syn-ack unasked
+  conn.SetReadDeadline(time.Now().Add(time.Second))
+  if cnt, err := conn.Read(buffer); err != nil || parse_handshake(buffer[:cnt]) == nil {
+    t.Fatalf("syn-ack not resent %v", err)
+  }
+  // session packets don't get more of them, spoofed ones would be
+  // amplified
+  for i := 0; i < 10; i++ {
+    conn.Write(push)
+  }
+  conn.SetReadDeadline(time.Now().Add(KDP_HANDSHAKE_RESEND / 4))
+  if _, err := conn.Read(buffer); err == nil {
+    t.Fatalf("session packet answered before the resend is due")
+  }
+  conn.SetReadDeadline(time.Now().Add(time.Second))
+  conn.Write(handshake_packet(synack.conv, KCP_CMD_SYNACK, 77, synack.sn + 1))
+  if stats, _ := server.Stats(); len(stats) != 0 {
+    t.Fatalf("session created before handshake completes")
+  }
+  
+  conn.Write(handshake_packet(synack.conv, KCP_CMD_SYNACK, 77, synack.sn))
+  accepted := make(chan *KDP, 1)
+  go func() {
+    if kdp, err := server.AcceptKDP(); err == nil {
+      accepted <- kdp
+    }
+  }()
+  select {
+  case kdp := <- accepted:
+    if kdp.kcp.conv != synack.conv {
+      t.Errorf("accepted conv %d, assigned %d", kdp.kcp.conv, synack.conv)
+    }
+  case <- time.After(3 * time.Second):
+    t.Fatalf("session not accepted")
+  }
+}
+
+func TestDialConv(t *testing.T) {
+  server, err := Listen("0.0.0.0:9010", nil)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+  convs, config := make(map[uint32]bool), DefaultConfig()
+  config.Linger = -1
+  for i := 0; i < 3; i++ {
+    client, err := Dial("127.0.0.1:9010", config)
+    if err != nil {
+      t.Fatalf("dial failed %v", err)
+    }
+    defer client.Close()
+    if sock, err := server.AcceptKDP(); err != nil {
+      t.Fatalf("accept failed %v", err)
+    } else if sock.kcp.conv != client.pipe.kcp.conv {
+      t.Errorf("conv not match %d/%d", sock.kcp.conv, client.pipe.kcp.conv)
+    }
+    convs[client.pipe.kcp.conv] = true
+  }
+  if len(convs) != 3 {
+    t.Errorf("conv reused %v", convs)
+  }
+}
+
+func TestKeyExchange(t *testing.T) {
+  ids := make([]*Identity, 3)
+  for i := range ids {
+    ids[i], _ = NewIdentity()
+  }
+  config := DefaultConfig()
+  config.Identity, config.Linger = ids[0], -1
+  config.KnownPeers = KnownPeers{ids[1].Public(): "client"}
+  server, err := Listen("0.0.0.0:9010", config)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+
+  dial := func(id *Identity, peers KnownPeers) (*Client, error) {
+    config := DefaultConfig()
+    config.Identity, config.KnownPeers, config.Linger = id, peers, -1
+    ctx, cancel := context.WithTimeout(context.Background(), 500 * time.Millisecond)
+    defer cancel()
+    return DialContext(ctx, "127.0.0.1:9010", config)
+  }
+  // the last step is not answered, an unknown client only sees its
+  // session never gets through
+  refused := DefaultSnmp.Copy().PeerRefused
+  if client, err := dial(ids[2], nil); err == nil {
+    client.Close()
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+  defer cancel()
+  if _, err := server.AcceptContext(ctx); err != context.DeadlineExceeded {
+    t.Errorf("unknown client accepted %v", err)
+  } else if DefaultSnmp.Copy().PeerRefused == refused {
+    t.Errorf("unknown client not counted")
+  }
+  if _, err := dial(nil, nil); err != context.DeadlineExceeded {
+    t.Errorf("dial without identity returns %v", err)
+  }
+  if _, err := dial(ids[1], KnownPeers{ids[2].Public(): "other"}); err != ErrPeerRefused {
+    t.Errorf("dial to unknown server returns %v", err)
+  }
+
+  client, err := dial(ids[1], KnownPeers{ids[0].Public(): "server"})
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  defer client.Close()
+  sock, err := server.AcceptKDP()
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  } else if sock.crypt == nil || sock.crypt == server.crypt {
+    t.Fatalf("session without traffic keys")
+  }
+  // each direction has its own key
+  sealed := client.pipe.crypt.Seal([]byte("ping"), client.pipe.kcp.conv, 1)
+  if _, _, err := client.pipe.crypt.Open(append([]byte(nil), sealed...)); err != ErrAuth {
+    t.Errorf("client opens its own packets")
+  } else if _, data, err := sock.crypt.Open(sealed); err != nil || string(data) != "ping" {
+    t.Errorf("server opens %q %v", data, err)
+  }
+  if _, err := client.Write([]byte("hello")); err != nil {
+    t.Fatalf("write failed %v", err)
+  }
+  buffer := make([]byte, 100)
+  if cnt, err := sock.Read(buffer); err != nil || string(buffer[:cnt]) != "hello" {
+    t.Errorf("read %q %v", buffer[:cnt], err)
+  }
+}
+
+func TestHandshakeHeader(t *testing.T) {
+  syn := kx_packet(0, KCP_CMD_SYN, 77, 0, make([]byte, KDP_COOKIE_SIZE))
+  if seg := parse_handshake(syn); seg == nil || seg.cmd != KCP_CMD_SYN || seg.sn != 77 {
+    t.Fatalf("handshake packet not parsed %v", seg)
+  }
+  // the same segment as a session packet, bare or behind fec
+  if parse_handshake(syn[KDP_HANDSHAKE_HEADER:]) != nil {
+    t.Errorf("kcp packet taken for a handshake")
+  }
+  enc, _ := NewFecEncoder(1, 1)
+  for _, pkt := range enc.Encode(syn[KDP_HANDSHAKE_HEADER:]) {
+    if is_handshake(pkt) {
+      t.Errorf("fec packet taken for a handshake")
+    }
+  }
+}
+
+func TestCookie(t *testing.T) {
+  server := new(Server)
+  server.init()
+  raddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+  now := uint32(time.Now().Unix())
+  cookie := server.cookie(raddr, 77, now)
+  if !server.check_cookie(cookie, raddr, 77) {
+    t.Errorf("valid cookie refused")
+  }
+  other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 4000}
+  if server.check_cookie(cookie, other, 77) {
+    t.Errorf("cookie of another address accepted")
+  } else if server.check_cookie(cookie, &net.UDPAddr{IP: raddr.IP, Port: 4001}, 77) {
+    t.Errorf("cookie of another port accepted")
+  }
+  old := server.cookie(raddr, 77, now - uint32(KDP_COOKIE_LIFE / time.Second) - 1)
+  if server.check_cookie(old, raddr, 77) {
+    t.Errorf("expired cookie accepted")
+  }
+  forged := append([]byte(nil), cookie...)
+  forged[0]--
+  if server.check_cookie(forged, raddr, 77) {
+    t.Errorf("cookie with changed time accepted")
+  }
+  another := new(Server)
+  another.init()
+  if another.check_cookie(cookie, raddr, 77) {
+    t.Errorf("cookie of another server accepted")
+  }
+}
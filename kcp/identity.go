@@ -0,0 +1,83 @@
+package kcp
+
+import (
+  "os"
+  "fmt"
+  "bufio"
+  "strings"
+  "crypto/rand"
+  "crypto/ed25519"
+  "encoding/base64"
+)
+
+// Identity is the long-term ed25519 key a peer proves itself with during
+// the key exchange. Its file holds the base64 seed of the key.
+type Identity struct {
+  key ed25519.PrivateKey
+}
+
+// KnownPeers maps the base64 public keys of the peers allowed to connect
+// to their names. A nil KnownPeers allows any peer.
+type KnownPeers map[string]string
+
+func NewIdentity() (*Identity, error) {
+  _, key, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil {
+    return nil, err
+  }
+  return &Identity{key: key}, nil
+}
+
+func LoadIdentity(path string) (*Identity, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+  if err != nil || len(seed) != ed25519.SeedSize {
+    return nil, fmt.Errorf("bad identity file %s", path)
+  }
+  return &Identity{key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// Save writes the identity to path, readable by the owner only.
+func (id *Identity) Save(path string) error {
+  seed := base64.StdEncoding.EncodeToString(id.key.Seed())
+  return os.WriteFile(path, []byte(seed + "\n"), 0600)
+}
+
+// Public returns the public key to put in the known peers of others.
+func (id *Identity) Public() string {
+  return base64.StdEncoding.EncodeToString(id.key.Public().(ed25519.PublicKey))
+}
+
+// LoadKnownPeers reads one public key per line, optionally followed by
+// the peer name, lines starting with # are skipped.
+func LoadKnownPeers(path string) (KnownPeers, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  peers := make(KnownPeers)
+  scanner := bufio.NewScanner(file)
+  for line := 1; scanner.Scan(); line++ {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+      continue
+    }
+    if key, err := base64.StdEncoding.DecodeString(fields[0]); err != nil || len(key) != ed25519.PublicKeySize {
+      return nil, fmt.Errorf("%s:%d: bad public key", path, line)
+    }
+    peers[fields[0]] = strings.Join(fields[1:], " ")
+  }
+  return peers, scanner.Err()
+}
+
+func (peers KnownPeers) allow(key []byte) bool {
+  if peers == nil {
+    return true
+  }
+  _, ok := peers[base64.StdEncoding.EncodeToString(key)]
+  return ok
+}
@@ -0,0 +1,40 @@
+package kcp
+
+import (
+  "os"
+  "testing"
+  "path/filepath"
+)
+
+func TestIdentityFiles(t *testing.T) {
+  dir := t.TempDir()
+  id, err := NewIdentity()
+  if err != nil {
+    t.Fatalf("create identity failed %v", err)
+  }
+  path := filepath.Join(dir, "id")
+  if err := id.Save(path); err != nil {
+    t.Fatalf("save failed %v", err)
+  }
+  if loaded, err := LoadIdentity(path); err != nil || loaded.Public() != id.Public() {
+    t.Errorf("loaded identity differs %v", err)
+  }
+  os.WriteFile(path, []byte("short"), 0600)
+  if _, err := LoadIdentity(path); err == nil {
+    t.Errorf("bad identity loaded")
+  }
+
+  other, _ := NewIdentity()
+  path = filepath.Join(dir, "peers")
+  os.WriteFile(path, []byte("# peers\n" + id.Public() + " alice laptop\n\n" + other.Public() + "\n"), 0600)
+  peers, err := LoadKnownPeers(path)
+  if err != nil {
+    t.Fatalf("load peers failed %v", err)
+  } else if len(peers) != 2 || peers[id.Public()] != "alice laptop" {
+    t.Errorf("peers %v", peers)
+  }
+  os.WriteFile(path, []byte(id.Public() + "\nnot-a-key\n"), 0600)
+  if _, err := LoadKnownPeers(path); err == nil {
+    t.Errorf("bad peer key accepted")
+  }
+}
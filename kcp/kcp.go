@@ -1,9 +1,10 @@
 package kcp
 
 import (
-  "bytes"
+  "io"
   "errors"
 	"fmt"
+  "encoding/binary"
 )
 
 const (
@@ -27,31 +28,68 @@ const (
   KCP_CMD_ACK = 82
   KCP_CMD_WASK = 83
   KCP_CMD_WINS = 84
+  KCP_CMD_SACK = 85
+  KCP_CMD_SYN = 86
+  KCP_CMD_SYNACK = 87
+  KCP_CMD_FIN = 88
+  KCP_CMD_FINACK = 89
+  KCP_CMD_PING = 90
+  KCP_CMD_PONG = 91
+  KCP_CMD_COOKIE = 92
 )
 
 const (
   KCP_ASK_SEND = 1 
   KCP_ASK_TELL = 2 
+  KCP_ASK_FIN = 4
+  KCP_ASK_PONG = 8
   KCP_PROBE_INIT = 7000 
   KCP_PROBE_LIMIT = 120000 
 )
 
+const (
+  KCP_FIN_SEND = 1
+  KCP_FIN_ACKED = 2
+  KCP_FIN_RECV = 4
+)
+
+var (
+  ErrWriteClosed = errors.New("write side closed")
+  ErrDeadLink = errors.New("dead link")
+  ErrIdleTimeout = errors.New("idle timeout")
+  ErrWouldBlock = errors.New("send buffer full")
+  ErrEmptyData = errors.New("empty data")
+  ErrNoData = errors.New("rcv queue empty")
+  ErrShortBuffer = errors.New("rcv buffer too small")
+  ErrConvMismatch = errors.New("conv not match")
+)
+
 type KCP struct {
   conv, mtu, mss, state uint32
   snd_una, snd_nxt, rcv_nxt uint32
-  ts_recent, ts_lastack, ssthresh uint32
+  ts_recent, ts_lastack uint32
   rx_rttval, rx_srtt, rx_rto, rx_minrto uint32
-  snd_wnd, rcv_wnd, rmt_wnd, cwnd, probe uint32
+  snd_wnd, rcv_wnd, rmt_wnd, probe uint32
   current, interval, ts_flush, xmit uint32
   nodelay, updated uint32
   ts_probe, probe_wait uint32
-  dead_link, incr uint32
+  dead_link uint32
   snd_queue, snd_buf *Queue
+  snd_bytes uint32
   rcv_queue, rcv_buf *Queue
   acklist []uint32
   buffer []byte
   faskresend uint32
   nocwnd uint32
+  cc CongestionController
+  stream bool
+  sack bool
+  hold bool
+  fin, ts_fin uint32
+  keepalive, ts_recv, ts_ping uint32
+  // PONGs received, a path is confirmed by one after a PING
+  pongs uint32
+  stats Stats
   writer func([]byte) (int, error)
   debug bool
 }
@@ -74,10 +112,14 @@ func bound(lower, middle, upper uint32) uint32 {
   return min(max(lower, middle), upper)
 }
 
+// timediff compares sequence numbers and timestamps with serial number
+// arithmetic, so the result stays right when either of them wraps around.
 func timediff(later, earlier uint32) int {
-  return int(later) - int(earlier)
+  return int(int32(later - earlier))
 }
 
+// NewKCP creates a kcp control block, every packet produced by the
+// protocal will be handed to writer.
 func NewKCP(conv uint32, writer func([]byte)(int, error)) *KCP {
   kcp := new(KCP)
   kcp.init(conv, writer)
@@ -87,7 +129,7 @@ func NewKCP(conv uint32, writer func([]byte)(int, error)) *KCP {
 func (kcp *KCP) init(conv uint32, writer func([]byte)(int, error)) {
   kcp.conv = conv
   kcp.writer = writer
-  kcp.snd_wnd, kcp.rcv_wnd, kcp.rmt_wnd, kcp.cwnd = KCP_WND_SND, KCP_WND_RCV, KCP_WND_RCV, 1
+  kcp.snd_wnd, kcp.rcv_wnd, kcp.rmt_wnd = KCP_WND_SND, KCP_WND_RCV, KCP_WND_RCV
   kcp.mtu = KCP_MTU_DEF
   kcp.mss = KCP_MTU_DEF - KCP_OVERHEAD
   
@@ -97,84 +139,105 @@ func (kcp *KCP) init(conv uint32, writer func([]byte)(int, error)) {
   
   kcp.rx_rto, kcp.rx_minrto = KCP_RTO_DEF, KCP_RTO_MIN
   kcp.interval, kcp.ts_flush = KCP_INTERVAL, KCP_INTERVAL
-  kcp.ssthresh = KCP_THRESH_INIT
+  kcp.cc = NewReno()
   kcp.dead_link = KCP_DEADLINK
   kcp.state = 1
 }
 
+// reset_sn starts the sequence numbers at sn, both sides should match.
+// Tests move it close to 2^32 to exercise wraparound.
+func (kcp *KCP) reset_sn(sn uint32) {
+  kcp.snd_una, kcp.snd_nxt, kcp.rcv_nxt = sn, sn, sn
+}
+
+// SetOutput replaces the callback used to send out low level packets.
+func (kcp *KCP) SetOutput(writer func([]byte)(int, error)) {
+  kcp.writer = writer
+}
+
+// Conv returns the conversation id of this kcp.
+func (kcp *KCP) Conv() uint32 {
+  return kcp.conv
+}
+
 func (kcp *KCP) output(data []byte) error {
-  if len(data) == 0 {
+  if len(data) == 0 || kcp.writer == nil {
     return nil
   }
+  count(&kcp.stats.BytesSent, &DefaultSnmp.BytesSent, uint64(len(data)))
   cnt, err := kcp.writer(data)
-  if cnt != len(data) {
+  if err != nil {
+    return err
+  } else if cnt != len(data) {
     return errors.New("less data sent")
   }
-  return err
+  return nil
 }
 
-func (kcp *KCP) receive(peek bool) ([]byte, error) {
-  _, err := kcp.peeksize()
-  recover := false
-  
+// Recv copies the next complete message into buffer and returns its size.
+// ErrNoData is returned when no complete message has arrived yet, and
+// ErrShortBuffer when buffer can not hold the message. In stream mode
+// there is no message boundary, as many segments as buffer can hold
+// are merged.
+func (kcp *KCP) Recv(buffer []byte) (int, error) {
+  size, err := kcp.PeekSize()
   if err != nil {
-    return nil, err
+    return 0, err
+  } else if size > len(buffer) {
+    return 0, ErrShortBuffer
   }
   
+  recover := false
   if kcp.rcv_queue.Len() >= kcp.rcv_wnd {
     recover = true
   }
   
   // merge all data
-  var buffer bytes.Buffer
+  pos := 0
   for entry := kcp.rcv_queue.next; entry != kcp.rcv_queue; {
     seg := entry.val.(*Segment)
     next := entry.next
-    buffer.Write(seg.data)
-    if !peek {
-      kcp.rcv_queue.Delete(entry)
-    }
+    pos += copy(buffer[pos:], seg.data)
+    kcp.rcv_queue.Delete(entry)
     entry = next
-    if seg.frg == 0 {
+    if !kcp.stream && seg.frg == 0 {
+      break
+    } else if kcp.stream && (entry == kcp.rcv_queue || 
+        int(entry.val.(*Segment).len) > len(buffer) - pos) {
       break
     }
   } 
   
   // Move data from rcv_buf into rcv_queue
-  for kcp.rcv_buf.Len() > 0 {
-    entry := kcp.rcv_buf.next
-    seg := entry.val.(*Segment)
-    if seg.sn == kcp.rcv_nxt && kcp.rcv_queue.Len() < kcp.rcv_wnd {
-      kcp.rcv_buf.Delete(entry)
-      kcp.rcv_queue.PushNode(entry)
-      kcp.rcv_nxt++
-    } else {
-      break
-    }
-  }
+  kcp.move_buf()
   
   // tell remote side starting send data again
   if kcp.rcv_queue.Len() < kcp.rcv_wnd && recover {
     kcp.probe |= KCP_ASK_TELL
   }
-  return buffer.Bytes(), nil
+  return pos, nil
 }
 
-func (kcp *KCP) peeksize() (uint32, error) {
+// PeekSize returns the size of the next complete message in rcv_queue,
+// io.EOF once the remote side closed and all its data is received.
+func (kcp *KCP) PeekSize() (int, error) {
   if kcp.rcv_queue.Len() == 0 {
-    return 0, errors.New("empty queue")
+    if kcp.fin & KCP_FIN_RECV != 0 && kcp.rcv_buf.Len() == 0 {
+      return 0, io.EOF
+    }
+    return 0, ErrNoData
   }
 
   seg := kcp.rcv_queue.next.val.(*Segment)
   if seg.frg == 0 {
-    return seg.len, nil
+    return int(seg.len), nil
   } else if seg.frg + 1 > kcp.rcv_queue.Len() {
-    return 0, errors.New("rcv data not enough")
+    return 0, ErrNoData
   }
   
-  var rslt uint32
+  var rslt int
   for entry := kcp.rcv_queue.next; entry != kcp.rcv_queue; entry = entry.next {
-    rslt += entry.val.(*Segment).len
+    rslt += int(entry.val.(*Segment).len)
     if entry.val.(*Segment).frg == 0 {
       break
     }
@@ -182,34 +245,112 @@ func (kcp *KCP) peeksize() (uint32, error) {
   return rslt, nil
 }
 
-func (kcp *KCP) send(data []byte) error {
-  if data == nil || len(data) == 0 {
-    return errors.New("empty data")
+// Send splits data into segments and appends them to snd_queue, data
+// is copied so the caller may reuse it after Send returns. In stream mode
+// data is appended to the last queued segment first and there is no
+// limit on its size.
+func (kcp *KCP) Send(data []byte) error {
+  if len(data) == 0 {
+    return ErrEmptyData
+  } else if kcp.state == 0 {
+    return ErrDeadLink
+  } else if kcp.fin & KCP_FIN_SEND != 0 {
+    return ErrWriteClosed
+  }
+  
+  if kcp.stream && kcp.snd_queue.Len() > 0 {
+    tail := kcp.snd_queue.prev.val.(*Segment)
+    if tail.len < kcp.mss {
+      extend := min(kcp.mss - tail.len, uint32(len(data)))
+      tail.data = append(tail.data, data[:extend]...)
+      tail.len += extend
+      kcp.snd_bytes += extend
+      data = data[extend:]
+    }
+    if len(data) == 0 {
+      return nil
+    }
   }
   dlen := uint32(len(data))
   
   count := (dlen + kcp.mss - 1) / kcp.mss
-  if count >= KCP_WND_RCV {
+  if count >= KCP_WND_RCV && !kcp.stream {
     mesg := fmt.Sprintf("data size too large %d/%d", count, kcp.rmt_wnd)
     return errors.New(mesg)
   } else if count == 0 {
     count = 1
   }
   for i := uint32(0); i < count; i++ {
+    size := min(kcp.mss, uint32(len(data)))
     seg := NewSegment(kcp)
-    if i == count - 1 {
-      seg.data = data
+    if kcp.stream {
+      seg.data = make([]byte, size, kcp.mss)
     } else {
-      seg.data = data[:kcp.mss]
-      data = data[kcp.mss:]
+      seg.data = make([]byte, size)
+      seg.frg = count - i - 1
     }
-    seg.frg = count - i - 1
-    seg.len = uint32(len(seg.data))
+    copy(seg.data, data[:size])
+    data = data[size:]
+    seg.len = size
+    kcp.snd_bytes += size
     kcp.snd_queue.Push(seg)
   }
   return nil
 }
 
+// CloseWrite shuts down the sending side, a FIN is sent once every
+// queued segment is acked. Receiving is not affected.
+func (kcp *KCP) CloseWrite() {
+  if kcp.fin & KCP_FIN_SEND == 0 {
+    kcp.fin |= KCP_FIN_SEND
+    kcp.ts_fin = kcp.current
+  }
+}
+
+// Drained reports whether the FIN, and so all data before it, is acked.
+func (kcp *KCP) Drained() bool {
+  return kcp.fin & KCP_FIN_ACKED != 0
+}
+
+// PeerClosed reports whether the remote side sent FIN.
+func (kcp *KCP) PeerClosed() bool {
+  return kcp.fin & KCP_FIN_RECV != 0
+}
+
+// Dead reports whether a segment was sent dead_link times without
+// being acked, the remote side is considered gone then.
+func (kcp *KCP) Dead() bool {
+  return kcp.state == 0
+}
+
+// Idle returns millisec since the last packet from remote side arrived.
+func (kcp *KCP) Idle() uint32 {
+  if kcp.updated == 0 || timediff(kcp.current, kcp.ts_recv) < 0 {
+    return 0
+  }
+  return kcp.current - kcp.ts_recv
+}
+
+// WaitSnd returns how many segments are waiting to be sent or acked.
+func (kcp *KCP) WaitSnd() int {
+  return int(kcp.snd_buf.Len() + kcp.snd_queue.Len())
+}
+
+// WaitSndBytes returns the payload bytes waiting to be sent or acked.
+func (kcp *KCP) WaitSndBytes() int {
+  return int(kcp.snd_bytes)
+}
+
+// SendMark returns a mark past every segment queued so far, Acked tells
+// when all of them were acked.
+func (kcp *KCP) SendMark() uint32 {
+  return kcp.snd_nxt + kcp.snd_queue.Len()
+}
+
+func (kcp *KCP) Acked(mark uint32) bool {
+  return timediff(kcp.snd_una, mark) >= 0
+}
+
 // calculate rtt and rto
 func (kcp *KCP) update_ack(rtt uint32) {
   var rto uint32 = 0
@@ -231,7 +372,7 @@ func (kcp *KCP) update_ack(rtt uint32) {
     }
   }
   
-  rto = kcp.rx_srtt + max(1, 4 * kcp.rx_rttval)
+  rto = kcp.rx_srtt + max(kcp.interval, 4 * kcp.rx_rttval)
   kcp.rx_rto = bound(kcp.rx_minrto, rto, KCP_RTO_MAX)
 }
 
@@ -247,18 +388,18 @@ func (kcp *KCP) shrink_buf() {
 // rcv ack from remote side
 func (kcp *KCP) parse_ack(sn uint32) {
   // ack for old pkg or future pkg is invalid
-  if sn < kcp.snd_una || sn >= kcp.snd_nxt {
+  if timediff(sn, kcp.snd_una) < 0 || timediff(sn, kcp.snd_nxt) >= 0 {
     return
   }
   
   // got ack for queueed segment
   for entry := kcp.snd_buf.next; entry != kcp.snd_buf; entry = entry.next {
     seg := entry.val.(*Segment)
-    if seg.sn < sn {
+    if timediff(seg.sn, sn) < 0 {
       seg.fastack++
       continue
     } else if seg.sn == sn {
-      kcp.snd_buf.Delete(entry)
+      kcp.snd_acked(entry)
     }
     break
   }
@@ -267,21 +408,27 @@ func (kcp *KCP) parse_ack(sn uint32) {
 // rcv una from remote side
 func (kcp *KCP) parse_una(una uint32) {
   // una for old pkg or future pkg is invalid
-  if una < kcp.snd_una {
+  if timediff(una, kcp.snd_una) < 0 {
     return
   }
   
   for entry := kcp.snd_buf.next; entry != kcp.snd_buf; {
     seg := entry.val.(*Segment)
     next := entry.next
-    if seg.sn >= una {
+    if timediff(seg.sn, una) >= 0 {
       break
     }
-    kcp.snd_buf.Delete(entry)
+    kcp.snd_acked(entry)
     entry = next
   }
 }
 
+// snd_acked drops an acked segment from snd_buf
+func (kcp *KCP) snd_acked(entry *Queue) {
+  kcp.snd_bytes -= entry.val.(*Segment).len
+  kcp.snd_buf.Delete(entry)
+}
+
 func (kcp *KCP) ack_push(sn, ts uint32) {
   kcp.acklist = append(kcp.acklist, sn, ts)
 }
@@ -290,14 +437,15 @@ func (kcp *KCP) ack_get(pos uint32) (uint32, uint32) {
   return kcp.acklist[pos], kcp.acklist[pos + 1]
 }
 
-func (kcp *KCP) parse_data(seg *Segment) {
-  if seg.sn < kcp.rcv_nxt || seg.sn >= kcp.rcv_wnd + kcp.rcv_nxt  {
-    return
+// parse_data returns false if seg is a duplicate or outside the window
+func (kcp *KCP) parse_data(seg *Segment) bool {
+  if timediff(seg.sn, kcp.rcv_nxt) < 0 || timediff(seg.sn, kcp.rcv_nxt + kcp.rcv_wnd) >= 0 {
+    return false
   }
   
   entry, repeat := kcp.rcv_buf.prev, false
   for ; entry != kcp.rcv_buf; entry = entry.prev {
-    if entry.val.(*Segment).sn > seg.sn {
+    if timediff(entry.val.(*Segment).sn, seg.sn) > 0 {
       continue
     }
     if entry.val.(*Segment).sn == seg.sn {
@@ -310,53 +458,152 @@ func (kcp *KCP) parse_data(seg *Segment) {
   if !repeat {
     kcp.rcv_buf.After(entry, seg)
   }
+  kcp.move_buf()
+  return !repeat
+}
+
+// encode runs of continuous sn in rcv_buf as [start, end] pairs, as many
+// as one segment can hold, lower ranges first
+func (kcp *KCP) sack_ranges() []byte {
+  var ranges []byte
+  limit := int(kcp.mss / 8)
+  var start, end uint32
+  for entry := kcp.rcv_buf.next; entry != kcp.rcv_buf; entry = entry.next {
+    sn := entry.val.(*Segment).sn
+    if entry != kcp.rcv_buf.next && sn == end + 1 {
+      end = sn
+      continue
+    }
+    if entry != kcp.rcv_buf.next {
+      ranges = append_range(ranges, start, end)
+    }
+    if len(ranges) / 8 >= limit {
+      return ranges
+    }
+    start, end = sn, sn
+  }
+  if kcp.rcv_buf.Len() > 0 {
+    ranges = append_range(ranges, start, end)
+  }
+  return ranges
+}
+
+func append_range(ranges []byte, start, end uint32) []byte {
+  store := make([]byte, 8)
+  binary.LittleEndian.PutUint32(store, start)
+  binary.LittleEndian.PutUint32(store[4:], end)
+  return append(ranges, store...)
+}
+
+// rcv selective ack from remote side, segments covered by the ranges are
+// removed from snd_buf, holes below them count as out of order acks the
+// same way parse_ack does, so fast resend picks exactly the missing ones
+func (kcp *KCP) parse_sack(data []byte) {
+  cnt := len(data) / 8
+  if cnt == 0 {
+    return
+  }
   
-  for entry = kcp.rcv_buf.next; entry != kcp.rcv_buf; {
+  idx, above := cnt - 1, uint32(0)
+  for entry := kcp.snd_buf.prev; entry != kcp.snd_buf; {
     seg := entry.val.(*Segment)
-    next := entry.next
-    if seg.sn != kcp.rcv_nxt {
+    prev := entry.prev
+    for idx >= 0 && timediff(seg.sn, binary.LittleEndian.Uint32(data[idx * 8:])) < 0 {
+      idx--
+    }
+    if idx >= 0 && timediff(seg.sn, binary.LittleEndian.Uint32(data[idx * 8 + 4:])) <= 0 {
+      kcp.snd_acked(entry)
+      above++
+    } else if above > 0 {
+      seg.fastack += above
+    }
+    entry = prev
+  }
+}
+
+// move continuous segments from rcv_buf into rcv_queue
+func (kcp *KCP) move_buf() {
+  for kcp.rcv_buf.Len() > 0 {
+    entry := kcp.rcv_buf.next
+    seg := entry.val.(*Segment)
+    if seg.sn != kcp.rcv_nxt || kcp.rcv_queue.Len() >= kcp.rcv_wnd {
       break
     }
-    
     kcp.rcv_buf.Delete(entry)
     kcp.rcv_queue.PushNode(entry)
     kcp.rcv_nxt++
-    entry = next
   }
 }
 
-// rcv read received data and parse
+// Input parses low level packets received from the remote side.
+func (kcp *KCP) Input(data []byte) error {
+  err := kcp.input(data)
+  if err != nil {
+    count(&kcp.stats.InErrs, &DefaultSnmp.InErrs, 1)
+  }
+  return err
+}
+
 func (kcp *KCP) input(data []byte) error {
-  if data == nil || len(data) < KCP_OVERHEAD {
-    return errors.New("empty data")
+  if len(data) < KCP_OVERHEAD {
+    return ErrEmptyData
   }
-  una := kcp.snd_una
+  count(&kcp.stats.BytesRecv, &DefaultSnmp.BytesRecv, uint64(len(data)))
+  before, rtt := kcp.snd_buf.Len(), uint32(0)
   for true {
     seg, rslt, err := Decode(data)
     data = rslt
     if err != nil {
       return err
+    } else if seg.conv != kcp.conv {
+      return ErrConvMismatch
     }
     kcp.rmt_wnd = seg.wnd
+    kcp.ts_recv = kcp.current
     kcp.parse_una(seg.una)
     kcp.shrink_buf()
     
     switch seg.cmd {
       case KCP_CMD_ACK:
-        if seg.ts < kcp.current {
-          kcp.update_ack(kcp.current - seg.ts)
+        if timediff(kcp.current, seg.ts) >= 0 {
+          rtt = kcp.current - seg.ts
+          kcp.update_ack(rtt)
         }
         kcp.parse_ack(seg.sn)
         kcp.shrink_buf()
       case KCP_CMD_PUSH:
-        if seg.sn > kcp.rcv_wnd + kcp.rcv_nxt {
-          return errors.New("rcv buffer full")
+        count(&kcp.stats.SegsRecv, &DefaultSnmp.SegsRecv, 1)
+        if timediff(seg.sn, kcp.rcv_nxt + kcp.rcv_wnd) < 0 {
+          kcp.ack_push(seg.sn, seg.ts)
         }
-        kcp.parse_data(seg)
-        kcp.ack_push(seg.sn, seg.ts)
+        if !kcp.parse_data(seg) {
+          count(&kcp.stats.Duplicates, &DefaultSnmp.Duplicates, 1)
+        }
+      case KCP_CMD_SACK:
+        if timediff(kcp.current, seg.ts) >= 0 {
+          rtt = kcp.current - seg.ts
+          kcp.update_ack(rtt)
+        }
+        kcp.parse_sack(seg.data)
+        kcp.shrink_buf()
       case KCP_CMD_WASK:
         kcp.probe |= KCP_ASK_TELL
       case KCP_CMD_WINS:
+      case KCP_CMD_FIN:
+        // FIN is sent after all data is acked, it's accepted only when
+        // nothing before it is missing
+        if timediff(seg.sn, kcp.rcv_nxt) <= 0 {
+          kcp.fin |= KCP_FIN_RECV
+          kcp.probe |= KCP_ASK_FIN
+        }
+      case KCP_CMD_FINACK:
+        if kcp.fin & KCP_FIN_SEND != 0 {
+          kcp.fin |= KCP_FIN_ACKED
+        }
+      case KCP_CMD_PING:
+        kcp.probe |= KCP_ASK_PONG
+      case KCP_CMD_PONG:
+        kcp.pongs++
       default:
         return errors.New("unknown data command")
     }
@@ -365,23 +612,8 @@ func (kcp *KCP) input(data []byte) error {
       break
     }
   }
-  if kcp.snd_una > una && kcp.cwnd < kcp.rmt_wnd {
-    if kcp.cwnd < kcp.ssthresh {
-      kcp.cwnd++
-      kcp.incr = kcp.mss
-    } else {
-      if kcp.incr < kcp.mss {
-        kcp.incr = kcp.mss
-      }
-      kcp.incr += kcp.mss * kcp.mss / kcp.incr + kcp.mss / 16
-      if (kcp.cwnd + 1) * kcp.mss < kcp.incr {
-        kcp.cwnd++
-      }
-    }
-    if kcp.cwnd > kcp.rmt_wnd {
-      kcp.cwnd = kcp.rmt_wnd
-      kcp.incr = kcp.mss * kcp.rmt_wnd
-    }
+  if acked := before - kcp.snd_buf.Len(); acked > 0 {
+    kcp.cc.OnAck(kcp.cc_state(), acked, rtt)
   }
   return nil
 }
@@ -393,9 +625,11 @@ func (kcp *KCP) wnd_unused() uint32 {
   return 0
 }
 
-func (kcp *KCP) flush() error {
+// Flush sends out pending acks, window probes and data segments allowed by
+// the current window. It does nothing before Update has been called.
+func (kcp *KCP) Flush() {
   if kcp.updated == 0 {
-    return errors.New("updated has not been called")
+    return
   }
   var pos, current uint32 = 0, kcp.current
   seg := NewSegment(kcp)
@@ -403,25 +637,42 @@ func (kcp *KCP) flush() error {
   seg.una = kcp.rcv_nxt
   seg.wnd = kcp.wnd_unused()
   
-  for i := 0; i < len(kcp.acklist); i += 2 {
-    seg.sn, seg.ts = kcp.ack_get(uint32(i))
-    if pos + KCP_OVERHEAD > kcp.mtu {
+  if kcp.sack && len(kcp.acklist) > 0 {
+    // one sack carries una and the received ranges beyond it, it echoes
+    // the ts of the latest segment for rtt
+    seg.cmd = KCP_CMD_SACK
+    seg.ts = kcp.acklist[len(kcp.acklist) - 1]
+    seg.data = kcp.sack_ranges()
+    if pos + KCP_OVERHEAD + uint32(len(seg.data)) > kcp.mtu {
       kcp.output(kcp.buffer[:pos])
       pos = 0
     }
     seg.Encode(kcp.buffer[pos:])
-    pos += KCP_OVERHEAD
+    pos += KCP_OVERHEAD + uint32(len(seg.data))
+    seg.data = nil
+    seg.cmd = KCP_CMD_ACK
+  } else {
+    for i := 0; i < len(kcp.acklist); i += 2 {
+      seg.sn, seg.ts = kcp.ack_get(uint32(i))
+      if pos + KCP_OVERHEAD > kcp.mtu {
+        kcp.output(kcp.buffer[:pos])
+        pos = 0
+      }
+      seg.Encode(kcp.buffer[pos:])
+      pos += KCP_OVERHEAD
+    }
   }
-  kcp.acklist = []uint32{}
+  kcp.acklist = kcp.acklist[:0]
   
   if kcp.rmt_wnd == 0 {
     if kcp.probe_wait == 0 {
       kcp.probe_wait = KCP_PROBE_INIT
       kcp.ts_probe = current + kcp.probe_wait
-    } else if current > kcp.ts_probe {
+    } else if timediff(current, kcp.ts_probe) >= 0 {
       kcp.probe_wait = max(kcp.probe_wait, KCP_PROBE_INIT)
       kcp.probe_wait += kcp.probe_wait / 2
       kcp.probe_wait = min(kcp.probe_wait, KCP_PROBE_LIMIT)
+      kcp.ts_probe = current + kcp.probe_wait
       kcp.probe |= KCP_ASK_SEND
     }
   } else {
@@ -429,18 +680,29 @@ func (kcp *KCP) flush() error {
     kcp.probe_wait = 0
   }
   
-  if kcp.probe & KCP_ASK_TELL == 1 {
+  seg.sn, seg.ts = 0, 0
+  if kcp.probe & KCP_ASK_SEND != 0 {
+    seg.cmd = KCP_CMD_WASK
+    if pos + KCP_OVERHEAD > kcp.mtu {
+      kcp.output(kcp.buffer[:pos])
+      pos = 0
+    }
+    seg.Encode(kcp.buffer[pos:])
+    pos += KCP_OVERHEAD
+  }
+  
+  if kcp.probe & KCP_ASK_TELL != 0 {
     seg.cmd = KCP_CMD_WINS
     if pos + KCP_OVERHEAD > kcp.mtu {
-       kcp.output(kcp.buffer[:pos])
+      kcp.output(kcp.buffer[:pos])
       pos = 0
     }
     seg.Encode(kcp.buffer[pos:])
     pos += KCP_OVERHEAD
   }
   
-  if kcp.probe & KCP_ASK_SEND == 1 {
-    seg.cmd = KCP_CMD_WASK
+  if kcp.probe & KCP_ASK_FIN != 0 {
+    seg.cmd = KCP_CMD_FINACK
     if pos + KCP_OVERHEAD > kcp.mtu {
       kcp.output(kcp.buffer[:pos])
       pos = 0
@@ -448,14 +710,33 @@ func (kcp *KCP) flush() error {
     seg.Encode(kcp.buffer[pos:])
     pos += KCP_OVERHEAD
   }
-  kcp.probe = 0
   
-  cwnd := min(kcp.snd_wnd, kcp.rmt_wnd)
-  if kcp.nocwnd == 0 {
-    cwnd = min(kcp.cwnd, cwnd)
+  if kcp.probe & KCP_ASK_PONG != 0 {
+    seg.cmd = KCP_CMD_PONG
+    if pos + KCP_OVERHEAD > kcp.mtu {
+      kcp.output(kcp.buffer[:pos])
+      pos = 0
+    }
+    seg.Encode(kcp.buffer[pos:])
+    pos += KCP_OVERHEAD
   }
   
-  for cwnd + kcp.snd_una > kcp.snd_nxt {
+  // ping once every keepalive while nothing arrives
+  if kcp.keepalive > 0 && timediff(current, kcp.ts_recv + kcp.keepalive) >= 0 && 
+      timediff(current, kcp.ts_ping) >= 0 {
+    seg.cmd = KCP_CMD_PING
+    if pos + KCP_OVERHEAD > kcp.mtu {
+      kcp.output(kcp.buffer[:pos])
+      pos = 0
+    }
+    seg.Encode(kcp.buffer[pos:])
+    pos += KCP_OVERHEAD
+    kcp.ts_ping = current + kcp.keepalive
+  }
+  kcp.probe = 0
+  
+  cwnd := kcp.cwnd()
+  for !kcp.hold && timediff(kcp.snd_nxt, kcp.snd_una + cwnd) < 0 {
     entry := kcp.snd_queue.Pop()
     if entry == nil {
       break
@@ -494,8 +775,9 @@ func (kcp *KCP) flush() error {
       seg.rto = kcp.rx_rto
       seg.resendts = current + seg.rto + rtomin
       send = true
-    } else if seg.resendts < current {
+    } else if timediff(current, seg.resendts) >= 0 {
       seg.xmit++
+      kcp.xmit++
       if kcp.nodelay == 0 {
         seg.rto += kcp.rx_rto
       } else {
@@ -503,11 +785,13 @@ func (kcp *KCP) flush() error {
       }
       seg.resendts = current + seg.rto
       lost, send = true, true
+      count(&kcp.stats.TimeoutRetrans, &DefaultSnmp.TimeoutRetrans, 1)
     } else if seg.fastack >= resent {
       seg.xmit++
       seg.fastack = 0
       seg.resendts = current + seg.rto
       send, change = true, true
+      count(&kcp.stats.FastRetrans, &DefaultSnmp.FastRetrans, 1)
     }
     
     if !send {
@@ -523,11 +807,27 @@ func (kcp *KCP) flush() error {
     seg.ts = current
     seg.Encode(kcp.buffer[pos:])
     pos += KCP_OVERHEAD + seg.len
+    count(&kcp.stats.SegsSent, &DefaultSnmp.SegsSent, 1)
     if seg.xmit >= kcp.dead_link {
       kcp.state = 0
     }
   }
   
+  // FIN goes after the last data segment is acked, and again every rto
+  // until FIN-ACK arrives
+  if kcp.fin & (KCP_FIN_SEND | KCP_FIN_ACKED) == KCP_FIN_SEND && kcp.WaitSnd() == 0 && 
+      timediff(current, kcp.ts_fin) >= 0 {
+    seg.cmd, seg.sn, seg.ts = KCP_CMD_FIN, kcp.snd_nxt, current
+    seg.una, seg.wnd = kcp.rcv_nxt, kcp.wnd_unused()
+    if pos + KCP_OVERHEAD > kcp.mtu {
+      kcp.output(kcp.buffer[:pos])
+      pos = 0
+    }
+    seg.Encode(kcp.buffer[pos:])
+    pos += KCP_OVERHEAD
+    kcp.ts_fin = current + kcp.rx_rto
+  }
+  
   // flushing remaining data
   if pos != 0 {
     kcp.output(kcp.buffer[:pos])
@@ -536,99 +836,171 @@ func (kcp *KCP) flush() error {
   
   // calculating congestion window
   if change {
-    inflight := kcp.snd_nxt - kcp.snd_una
-    kcp.ssthresh = max(inflight / 2, KCP_THRESH_MIN)
-    kcp.cwnd = kcp.ssthresh + resent
-    kcp.incr = kcp.cwnd * kcp.mss
-  } else if lost {
-    kcp.ssthresh = max(kcp.cwnd / 2, KCP_THRESH_MIN)
-    kcp.cwnd = 1
-    kcp.incr = kcp.mss
+    kcp.cc.OnLoss(kcp.cc_state())
+  } 
+  if lost {
+    kcp.cc.OnTimeout(kcp.cc_state())
   }
-  
-  if kcp.cwnd < 1 {
-    kcp.cwnd = 1
-    kcp.incr = kcp.mss
+}
+
+func (kcp *KCP) cc_state() *CongestionState {
+  state := new(CongestionState)
+  state.Mss, state.Inflight = kcp.mss, kcp.snd_nxt - kcp.snd_una
+  state.SndWnd, state.RmtWnd = kcp.snd_wnd, kcp.rmt_wnd
+  state.Resend, state.Srtt = kcp.faskresend, kcp.rx_srtt
+  state.Current = kcp.current
+  return state
+}
+
+// segments allowed in flight
+func (kcp *KCP) cwnd() uint32 {
+  cwnd := min(kcp.snd_wnd, kcp.rmt_wnd)
+  if kcp.nocwnd == 0 {
+    cwnd = min(kcp.cc.Cwnd(), cwnd)
   }
-  return nil
+  return cwnd
 }
 
-func (kcp *KCP) update(current uint32) error {
+// PacingRate returns the rate in bytes per second output should be
+// spread at, it's the congestion controller's rate if it has one, or a
+// window per smoothed rtt. 0 means no rtt is measured yet.
+func (kcp *KCP) PacingRate() uint32 {
+  if rate := kcp.cc.PacingRate(); rate > 0 {
+    return rate
+  } else if kcp.rx_srtt == 0 {
+    return 0
+  }
+  // a quarter more leaves room for acks and retransmissions
+  rate := uint64(kcp.cwnd()) * uint64(kcp.mtu) * 1000 / uint64(kcp.rx_srtt)
+  rate += rate / 4
+  if rate > 0xffffffff {
+    rate = 0xffffffff
+  }
+  return uint32(rate)
+}
+
+// Update drives the kcp state machine, it should be called repeatedly
+// (every 10ms-100ms), or at the time returned by Check. current is a
+// timestamp in millisec.
+func (kcp *KCP) Update(current uint32) {
   kcp.current = current
   if kcp.updated == 0 {
     kcp.updated = 1
-    kcp.ts_flush = kcp.current + kcp.interval
+    kcp.ts_flush = kcp.current
+    kcp.ts_recv, kcp.ts_ping = kcp.current, kcp.current
   }
   
   slap := timediff(kcp.current, kcp.ts_flush)
-  if slap > 10000 || slap < -10000 {
+  if slap >= 10000 || slap < -10000 {
     kcp.ts_flush = kcp.current
     slap = 0
   }
   
   if slap < 0 {
-    return nil
+    return
   }
   
   kcp.ts_flush += kcp.interval
-  if kcp.ts_flush < kcp.current {
+  if timediff(kcp.current, kcp.ts_flush) >= 0 {
     kcp.ts_flush = kcp.current + kcp.interval
   }
-  return kcp.flush()
+  kcp.Flush()
 }
 
-func (kcp *KCP) check(current uint32) uint32 {
+// Check returns when Update should be invoked next, assuming no Input
+// or Send happens in between. It lets a caller with many sessions
+// schedule updates instead of polling each of them.
+func (kcp *KCP) Check(current uint32) uint32 {
   if kcp.updated == 0 {
     return current
   }
   
-  slap := timediff(current, kcp.ts_flush)
-  if slap > 10000 || slap < 0 {
+  ts_flush := kcp.ts_flush
+  slap := timediff(current, ts_flush)
+  if slap >= 10000 || slap < -10000 {
+    ts_flush = current
+  }
+  if timediff(current, ts_flush) >= 0 {
     return current
   }
   
-  var recent uint32
+  tm_flush := timediff(ts_flush, current)
+  tm_packet := tm_flush
   for entry := kcp.snd_buf.next; entry != kcp.snd_buf; entry = entry.next {
-    seg := entry.val.(*Segment)
-    if seg.resendts < current {
+    diff := timediff(entry.val.(*Segment).resendts, current)
+    if diff <= 0 {
       return current
+    } else if diff < tm_packet {
+      tm_packet = diff
     }
-    
-    if recent == 0 {
-      recent = seg.resendts
-    } else if recent < seg.resendts {
-      recent = seg.resendts
-    }
   }
-  rslt := min(recent, kcp.ts_flush)
-  return min(rslt, current + kcp.interval)
+  
+  minimal := uint32(tm_packet)
+  return current + min(minimal, kcp.interval)
+}
+
+// SetStream switches between message mode and stream mode, both sides
+// of a session should use the same mode.
+func (kcp *KCP) SetStream(stream bool) {
+  kcp.stream = stream
+}
+
+// SetSack makes the receiver acknowledge with one sack segment carrying
+// ranges of received sn instead of one ack segment per sn. The remote
+// side must understand KCP_CMD_SACK.
+func (kcp *KCP) SetSack(sack bool) {
+  kcp.sack = sack
+}
+
+// SetHold keeps queued data out of the send window while hold is set,
+// acks, probes and retransmissions are still flushed.
+func (kcp *KCP) SetHold(hold bool) {
+  kcp.hold = hold
+}
+
+// SetCongestion replaces the congestion controller, Reno is used by default.
+func (kcp *KCP) SetCongestion(cc CongestionController) {
+  if cc != nil {
+    kcp.cc = cc
+  }
 }
 
-func (kcp *KCP) setmtu(mtu uint32) error {
+// SetMtu changes the max size of low level packets, defaults to 1400.
+func (kcp *KCP) SetMtu(mtu int) error {
   if mtu < KCP_OVERHEAD || mtu < 50 {
     return errors.New("mtu too small")
   }
   
-  buffer := make([]byte, mtu)
-  kcp.mtu = mtu
-  kcp.mss = mtu - KCP_OVERHEAD
+  buffer := make([]byte, mtu + KCP_OVERHEAD)
+  kcp.mtu = uint32(mtu)
+  kcp.mss = kcp.mtu - KCP_OVERHEAD
   kcp.buffer = buffer
   return nil
 }
 
-func (kcp *KCP) set_interval(interval uint32) {
+// SetInterval changes the internal flush interval in millisec.
+func (kcp *KCP) SetInterval(interval int) {
   if interval > 5000 {
     interval = 5000
   } else if interval < 10 {
     interval = 10
   }
-  kcp.interval = interval
+  kcp.interval = uint32(interval)
 }
 
-func (kcp *KCP) set_nodelay(nodelay, interval, resend, nc uint32) {
-  kcp.set_interval(interval)
+// SetNoDelay configures the protocal like ikcp_nodelay, a negative value
+// keeps the current setting.
+//   nodelay: 0 disables nodelay mode, 1 enables it
+//   interval: internal flush interval in millisec
+//   resend: fast resend after this many out of order acks, 0 disables it
+//   nc: 1 disables congestion control
+func (kcp *KCP) SetNoDelay(nodelay, interval, resend, nc int) {
+  if interval >= 0 {
+    kcp.SetInterval(interval)
+  }
+  
   if nodelay >= 0 {
-    kcp.nodelay = nodelay
+    kcp.nodelay = uint32(nodelay)
     if nodelay == 0 {
       kcp.rx_minrto = KCP_RTO_MIN
     } else {
@@ -637,20 +1009,45 @@ func (kcp *KCP) set_nodelay(nodelay, interval, resend, nc uint32) {
   }
   
   if resend >= 0 {
-    kcp.faskresend = resend
+    kcp.faskresend = uint32(resend)
   }
   
   if nc >= 0 {
-    kcp.nocwnd = nc
+    kcp.nocwnd = uint32(nc)
+  }
+}
+
+// SetMinRto changes the lower bound of rto in millisec, SetNoDelay resets it.
+func (kcp *KCP) SetMinRto(minrto int) {
+  if minrto > 0 {
+    kcp.rx_minrto = uint32(minrto)
   }
 }
 
-func (kcp *KCP) wnd_size(rcv_wnd, snd_wnd uint32) {
-  if rcv_wnd > 0 {
-    kcp.rcv_wnd = rcv_wnd
+// SetDeadLink changes how many times a segment may be sent before the
+// link is considered dead.
+func (kcp *KCP) SetDeadLink(deadlink int) {
+  if deadlink > 0 {
+    kcp.dead_link = uint32(deadlink)
+  }
+}
+
+// SetKeepAlive sends a ping after interval millisec without packets from
+// remote side, 0 disables it.
+func (kcp *KCP) SetKeepAlive(interval int) {
+  if interval >= 0 {
+    kcp.keepalive = uint32(interval)
+  }
+}
+
+// WndSize sets the max send and receive window in segments, a
+// non-positive value keeps the current setting.
+func (kcp *KCP) WndSize(sndwnd, rcvwnd int) {
+  if sndwnd > 0 {
+    kcp.snd_wnd = uint32(sndwnd)
   }
   
-  if snd_wnd > 0 {
-    kcp.snd_wnd = snd_wnd
+  if rcvwnd > 0 {
+    kcp.rcv_wnd = uint32(rcvwnd)
   }
-}
\ No newline at end of file
+}
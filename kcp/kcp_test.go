@@ -1,6 +1,7 @@
 package kcp
 
 import (
+  "io"
   "log"
   "time"
   "math/rand"
@@ -136,21 +137,21 @@ func test(mode int, t *testing.T) {
   cudp.mode = 0
   ckcp := NewKCP(123456, cudp.Write)
   
-  skcp.wnd_size(128, 128)
-  ckcp.wnd_size(128, 128)
+  skcp.WndSize(128, 128)
+  ckcp.WndSize(128, 128)
   
   current := clock()
   slap := current + 20
   
   if mode == 0 {
-    skcp.set_nodelay(0, 10, 0, 0)
-    ckcp.set_nodelay(0, 10, 0, 0)
+    skcp.SetNoDelay(0, 10, 0, 0)
+    ckcp.SetNoDelay(0, 10, 0, 0)
   } else if mode == 1 {
-    skcp.set_nodelay(0, 10, 0, 1)
-    ckcp.set_nodelay(0, 10, 0, 1)
+    skcp.SetNoDelay(0, 10, 0, 1)
+    ckcp.SetNoDelay(0, 10, 0, 1)
   } else {
-    skcp.set_nodelay(1, 10, 2, 1)
-    ckcp.set_nodelay(1, 10, 2, 1)
+    skcp.SetNoDelay(1, 10, 2, 1)
+    ckcp.SetNoDelay(1, 10, 2, 1)
   }
   
   index, next, cnt := uint32(0), uint32(0), uint32(0)
@@ -158,15 +159,15 @@ func test(mode int, t *testing.T) {
     
     time.Sleep(1 * time.Millisecond)
     current = clock()
-    skcp.update(current)
-    ckcp.update(current)
+    skcp.Update(current)
+    ckcp.Update(current)
     
     for ; slap <= current; slap += 20 {
       buffer := make([]byte, 8)
       binary.LittleEndian.PutUint32(buffer, index)
       binary.LittleEndian.PutUint32(buffer[4:], current)
       index++
-      skcp.send(buffer)
+      skcp.Send(buffer)
     }
     
     if cnt + 100 < index {
@@ -177,7 +178,7 @@ func test(mode int, t *testing.T) {
     
     for true {
       if rcv := vnet.receive(2); rcv != nil {
-        ckcp.input(rcv)
+        ckcp.Input(rcv)
       } else {
         break
       }
@@ -185,23 +186,25 @@ func test(mode int, t *testing.T) {
     
     for true {
       if rcv := vnet.receive(1); rcv != nil {
-        skcp.input(rcv)
+        skcp.Input(rcv)
       } else {
         break
       }
     }
     
+    buffer := make([]byte, 2048)
     for true {
-      if data, err := ckcp.receive(false); err != nil {
+      if size, err := ckcp.Recv(buffer); err != nil {
         break
       } else {
-        ckcp.send(data)
+        ckcp.Send(buffer[:size])
       }
     }
     for true {
-      if data, err := skcp.receive(false); err != nil {
+      if size, err := skcp.Recv(buffer); err != nil {
         break
       } else {
+        data := buffer[:size]
         idx := binary.LittleEndian.Uint32(data)
         //ts  := binary.LittleEndian.Uint32(data[4:])
         if idx != next {
@@ -217,3 +220,405 @@ func test(mode int, t *testing.T) {
     }
   }
 }
+
+// Loopback queues packets of one direction until they are delivered by
+// the test, so the whole session can be driven by a fake clock.
+type Loopback struct {
+  pkts [][]byte
+  drop, cnt, bytes int
+  lose func(cnt int) bool
+}
+
+func (lo *Loopback) Write(data []byte) (int, error) {
+  lo.cnt++
+  lo.bytes += len(data)
+  if lo.drop > 0 && lo.cnt % lo.drop == 0 {
+    return len(data), nil
+  } else if lo.lose != nil && lo.lose(lo.cnt) {
+    return len(data), nil
+  }
+  pkt := make([]byte, len(data))
+  copy(pkt, data)
+  lo.pkts = append(lo.pkts, pkt)
+  return len(data), nil
+}
+
+func (lo *Loopback) deliver(kcp *KCP) {
+  for _, pkt := range lo.pkts {
+    kcp.Input(pkt)
+  }
+  lo.pkts = nil
+}
+
+func TestSendRecv(t *testing.T) {
+  c2s, s2c := &Loopback{drop: 5}, new(Loopback)
+  ckcp, skcp := NewKCP(7, c2s.Write), NewKCP(7, s2c.Write)
+  ckcp.SetNoDelay(1, 10, 2, 1)
+  skcp.SetNoDelay(1, 10, 2, 1)
+  
+  sizes := []int{1, 1367, 1368, 5000, 30000, 7}
+  for i, size := range sizes {
+    data := make([]byte, size)
+    for j := range data {
+      data[j] = byte(i + j)
+    }
+    if err := ckcp.Send(data); err != nil {
+      t.Fatalf("send %d bytes failed %v", size, err)
+    }
+  }
+  if ckcp.Send(nil) != ErrEmptyData {
+    t.Errorf("empty send not rejected")
+  }
+  
+  var current uint32
+  recved := 0
+  for i := 0; i < 1000 && recved < len(sizes); i++ {
+    current += 10
+    ckcp.Update(current)
+    skcp.Update(current)
+    c2s.deliver(skcp)
+    s2c.deliver(ckcp)
+    
+    for recved < len(sizes) {
+      size, err := skcp.PeekSize()
+      if err != nil {
+        break
+      } else if size != sizes[recved] {
+        t.Fatalf("peek size not match %d/%d", size, sizes[recved])
+      }
+      buffer := make([]byte, size)
+      if _, err := skcp.Recv(buffer[:size - 1]); size > 1 && err != ErrShortBuffer {
+        t.Fatalf("short buffer not rejected %v", err)
+      }
+      if cnt, err := skcp.Recv(buffer); err != nil || cnt != size {
+        t.Fatalf("recv failed %d/%d %v", cnt, size, err)
+      }
+      for j := range buffer {
+        if buffer[j] != byte(recved + j) {
+          t.Fatalf("message %d content not match at %d", recved, j)
+        }
+      }
+      recved++
+    }
+  }
+  if recved != len(sizes) {
+    t.Fatalf("only %d/%d messages received", recved, len(sizes))
+  }
+  
+  for i := 0; i < 100 && ckcp.WaitSnd() > 0; i++ {
+    current += 10
+    ckcp.Update(current)
+    skcp.Update(current)
+    c2s.deliver(skcp)
+    s2c.deliver(ckcp)
+  }
+  if ckcp.WaitSnd() != 0 {
+    t.Errorf("segments not acked %d", ckcp.WaitSnd())
+  }
+  if next := ckcp.Check(current); next < current || next > current + 10 {
+    t.Errorf("check rslt out of range %d/%d", next, current)
+  }
+  if _, err := skcp.Recv(make([]byte, 10)); err != ErrNoData {
+    t.Errorf("empty queue not reported %v", err)
+  }
+}
+
+func TestConvMismatch(t *testing.T) {
+  out := new(Loopback)
+  ckcp, skcp := NewKCP(1, out.Write), NewKCP(2, nil)
+  ckcp.Send([]byte("hello"))
+  ckcp.Update(10)
+  if len(out.pkts) != 1 {
+    t.Fatalf("packet not sent %d", len(out.pkts))
+  }
+  if err := skcp.Input(out.pkts[0]); err != ErrConvMismatch {
+    t.Errorf("conv mismatch not detected %v", err)
+  }
+}
+
+func TestStream(t *testing.T) {
+  c2s, s2c := &Loopback{drop: 7}, new(Loopback)
+  ckcp, skcp := NewKCP(7, c2s.Write), NewKCP(7, s2c.Write)
+  ckcp.SetNoDelay(1, 10, 2, 1)
+  skcp.SetNoDelay(1, 10, 2, 1)
+  
+  large := make([]byte, 100 * 1024)
+  if err := ckcp.Send(large); err == nil {
+    t.Errorf("large message accepted in message mode")
+  }
+  ckcp.SetStream(true)
+  skcp.SetStream(true)
+  
+  var sent []byte
+  for _, size := range []int{10, 1000, 100 * 1024, 3, 5000} {
+    data := make([]byte, size)
+    for i := range data {
+      data[i] = byte(len(sent) + i)
+    }
+    if err := ckcp.Send(data); err != nil {
+      t.Fatalf("stream send %d failed %v", size, err)
+    }
+    sent = append(sent, data...)
+  }
+  if segs := uint32(len(sent)) / ckcp.mss + 1; ckcp.snd_queue.Len() != segs {
+    t.Errorf("stream data not packed %d/%d", ckcp.snd_queue.Len(), segs)
+  }
+  
+  var recved []byte
+  var current uint32
+  buffer := make([]byte, 3000)
+  for i := 0; i < 2000 && len(recved) < len(sent); i++ {
+    current += 10
+    ckcp.Update(current)
+    skcp.Update(current)
+    c2s.deliver(skcp)
+    s2c.deliver(ckcp)
+    for {
+      cnt, err := skcp.Recv(buffer)
+      if err != nil {
+        break
+      }
+      recved = append(recved, buffer[:cnt]...)
+    }
+  }
+  if len(recved) != len(sent) {
+    t.Fatalf("stream data lost %d/%d", len(recved), len(sent))
+  }
+  for i := range sent {
+    if sent[i] != recved[i] {
+      t.Fatalf("stream content not match at %d", i)
+    }
+  }
+}
+
+const wrap_sn = 0xFFFFFFFF - 300
+
+// near_wrap moves sequence numbers and clock of the sessions of config
+// close to 2^32.
+func near_wrap(config *Config) *Config {
+  config.sn_offset = wrap_sn
+  config.clock_offset = 0 - uint32(time.Now().UnixNano() / 1000000) - 2000
+  return config
+}
+
+func TestWrap(t *testing.T) {
+  c2s, s2c := &Loopback{drop: 6}, &Loopback{drop: 11}
+  ckcp, skcp := NewKCP(7, c2s.Write), NewKCP(7, s2c.Write)
+  ckcp.reset_sn(wrap_sn)
+  skcp.reset_sn(wrap_sn)
+  ckcp.SetNoDelay(1, 10, 2, 1)
+  skcp.SetNoDelay(1, 10, 2, 1)
+  ckcp.WndSize(128, 128)
+  skcp.WndSize(128, 128)
+  
+  current, total := uint32(0xFFFFFFFF - 100), 1000
+  start := current
+  sent, recved := 0, 0
+  buffer := make([]byte, 4)
+  for i := 0; i < 5000 && recved < total; i++ {
+    for ; sent < total && ckcp.WaitSnd() < 256; sent++ {
+      binary.LittleEndian.PutUint32(buffer, uint32(sent))
+      ckcp.Send(buffer)
+    }
+    current += 10
+    ckcp.Update(current)
+    skcp.Update(current)
+    c2s.deliver(skcp)
+    s2c.deliver(ckcp)
+    for {
+      if _, err := skcp.Recv(buffer); err != nil {
+        break
+      } else if idx := binary.LittleEndian.Uint32(buffer); idx != uint32(recved) {
+        t.Fatalf("receive pkg out of order %d/%d", idx, recved)
+      }
+      recved++
+    }
+  }
+  if recved != total {
+    t.Fatalf("only %d/%d messages received", recved, total)
+  }
+  if current > start {
+    t.Errorf("clock not wrapped %d/%d", start, current)
+  } else if ckcp.snd_nxt > wrap_sn || skcp.rcv_nxt > wrap_sn {
+    t.Errorf("sequence number not wrapped %d/%d", ckcp.snd_nxt, skcp.rcv_nxt)
+  }
+}
+
+func sack_session(sack bool, t *testing.T) (int, int) {
+  // one segment per packet, the 3rd to 7th packets are lost in a row
+  c2s := &Loopback{lose: func(cnt int) bool { return cnt >= 3 && cnt <= 7 }}
+  s2c := new(Loopback)
+  ckcp, skcp := NewKCP(7, c2s.Write), NewKCP(7, s2c.Write)
+  for _, kcp := range []*KCP{ckcp, skcp} {
+    kcp.SetNoDelay(1, 10, 2, 1)
+    kcp.WndSize(64, 64)
+    kcp.SetSack(sack)
+  }
+  
+  total, recved := 40, 0
+  for i := 0; i < total; i++ {
+    ckcp.Send(make([]byte, 1000))
+  }
+  buffer := make([]byte, 1000)
+  var current uint32
+  for i := 0; i < 1000 && recved < total; i++ {
+    current += 10
+    ckcp.Update(current)
+    skcp.Update(current)
+    c2s.deliver(skcp)
+    s2c.deliver(ckcp)
+    for {
+      if _, err := skcp.Recv(buffer); err != nil {
+        break
+      }
+      recved++
+    }
+  }
+  if recved != total {
+    t.Fatalf("sack %v only %d/%d messages received", sack, recved, total)
+  }
+  return c2s.cnt - total, s2c.bytes
+}
+
+func TestSack(t *testing.T) {
+  resent, ackbytes := sack_session(true, t)
+  if resent != 5 {
+    t.Errorf("sack resent %d segments for 5 lost", resent)
+  }
+  _, plain := sack_session(false, t)
+  if ackbytes >= plain {
+    t.Errorf("sack not smaller than plain acks %d/%d", ackbytes, plain)
+  }
+}
+
+func TestSackParse(t *testing.T) {
+  out := new(Loopback)
+  kcp := NewKCP(1, out.Write)
+  kcp.SetNoDelay(1, 10, 0, 1)
+  for i := 0; i < 10; i++ {
+    kcp.Send([]byte{byte(i)})
+  }
+  kcp.Update(10)
+  
+  // sn 2-3 and 6-7 received
+  var ranges []byte
+  ranges = append_range(ranges, 2, 3)
+  ranges = append_range(ranges, 6, 7)
+  kcp.parse_sack(ranges)
+  kcp.shrink_buf()
+  
+  expect := map[uint32]uint32{0: 4, 1: 4, 4: 2, 5: 2, 8: 0, 9: 0}
+  if kcp.snd_buf.Len() != uint32(len(expect)) {
+    t.Fatalf("sacked segments not removed %d", kcp.snd_buf.Len())
+  }
+  for entry := kcp.snd_buf.next; entry != kcp.snd_buf; entry = entry.next {
+    seg := entry.val.(*Segment)
+    if fastack, ok := expect[seg.sn]; !ok || seg.fastack != fastack {
+      t.Errorf("segment %d fastack %d, expect %d", seg.sn, seg.fastack, fastack)
+    }
+  }
+}
+
+func TestFin(t *testing.T) {
+  c2s, s2c := &Loopback{drop: 3}, &Loopback{drop: 4}
+  ckcp, skcp := NewKCP(7, c2s.Write), NewKCP(7, s2c.Write)
+  ckcp.SetNoDelay(1, 10, 2, 1)
+  skcp.SetNoDelay(1, 10, 2, 1)
+  for i := 0; i < 10; i++ {
+    ckcp.Send([]byte{byte(i)})
+  }
+  ckcp.CloseWrite()
+  if ckcp.Send([]byte{1}) != ErrWriteClosed {
+    t.Errorf("send after close write not rejected")
+  }
+  
+  var current uint32
+  buffer, recved, eof := make([]byte, 10), 0, false
+  for i := 0; i < 1000 && !(eof && ckcp.Drained()); i++ {
+    current += 10
+    ckcp.Update(current)
+    skcp.Update(current)
+    c2s.deliver(skcp)
+    s2c.deliver(ckcp)
+    for !eof {
+      if _, err := skcp.Recv(buffer); err == io.EOF {
+        eof = true
+      } else if err != nil {
+        break
+      } else if buffer[0] != byte(recved) {
+        t.Fatalf("message %d out of order", recved)
+      } else {
+        recved++
+      }
+    }
+  }
+  if recved != 10 || !eof {
+    t.Fatalf("%d messages received, eof %v", recved, eof)
+  } else if !ckcp.Drained() {
+    t.Fatalf("fin not acked")
+  }
+  
+  // the other direction is still open
+  if err := skcp.Send([]byte{9}); err != nil {
+    t.Fatalf("half closed peer can't send %v", err)
+  }
+  for i := 0; i < 100; i++ {
+    current += 10
+    skcp.Update(current)
+    ckcp.Update(current)
+    s2c.deliver(ckcp)
+    c2s.deliver(skcp)
+    if cnt, err := ckcp.Recv(buffer); err == nil && cnt == 1 && buffer[0] == 9 {
+      return
+    }
+  }
+  t.Errorf("data after half close not received")
+}
+
+func TestDeadLink(t *testing.T) {
+  out := &Loopback{lose: func(int) bool { return true }}
+  kcp := NewKCP(7, out.Write)
+  kcp.SetNoDelay(1, 10, 2, 1)
+  kcp.SetDeadLink(3)
+  kcp.Send([]byte{1})
+  var current uint32
+  for i := 0; i < 1000 && !kcp.Dead(); i++ {
+    current += 10
+    kcp.Update(current)
+  }
+  if !kcp.Dead() {
+    t.Fatalf("link not dead after %d packets lost", out.cnt)
+  } else if err := kcp.Send([]byte{2}); err != ErrDeadLink {
+    t.Errorf("send on dead link returns %v", err)
+  }
+}
+
+func TestKeepAlive(t *testing.T) {
+  c2s, s2c := new(Loopback), new(Loopback)
+  ckcp, skcp := NewKCP(7, c2s.Write), NewKCP(7, s2c.Write)
+  for _, kcp := range []*KCP{ckcp, skcp} {
+    kcp.SetNoDelay(1, 10, 2, 1)
+    kcp.SetKeepAlive(100)
+  }
+  var current uint32
+  for i := 0; i < 100; i++ {
+    current += 10
+    ckcp.Update(current)
+    skcp.Update(current)
+    c2s.deliver(skcp)
+    s2c.deliver(ckcp)
+  }
+  if c2s.cnt == 0 || ckcp.Idle() > 110 || skcp.Idle() > 110 {
+    t.Fatalf("no pings on idle session, %d sent idle %d/%d", c2s.cnt, ckcp.Idle(), skcp.Idle())
+  }
+  
+  // the server stops answering
+  for i := 0; i < 100; i++ {
+    current += 10
+    ckcp.Update(current)
+    c2s.pkts = nil
+  }
+  if ckcp.Idle() < 1000 {
+    t.Errorf("idle %d after 1s without answers", ckcp.Idle())
+  }
+}
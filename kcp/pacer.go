@@ -0,0 +1,100 @@
+package kcp
+
+import (
+  "time"
+  "sync/atomic"
+)
+
+const (
+  PACE_BURST = 2 * time.Millisecond
+  PACE_QUEUE = 4096
+)
+
+// Pacer is a token bucket which spreads packets at a rate in bytes per
+// second instead of sending a whole window in one burst. The bucket
+// holds at most PACE_BURST worth of tokens, but never less than burst
+// bytes, so burst should be the largest packet size.
+type Pacer struct {
+  rate uint32
+  burst int
+  tokens float64
+  last time.Time
+  queue [][]byte
+}
+
+func NewPacer(burst int) *Pacer {
+  pacer := new(Pacer)
+  pacer.burst = burst
+  pacer.tokens = float64(burst)
+  return pacer
+}
+
+// SetRate changes the pacing rate, 0 lets every packet through.
+func (pacer *Pacer) SetRate(rate uint32) {
+  pacer.rate = rate
+}
+
+// Push queues pkt, it's dropped if the queue is full.
+func (pacer *Pacer) Push(pkt []byte) bool {
+  if len(pacer.queue) >= PACE_QUEUE {
+    atomic.AddUint64(&DefaultSnmp.PacerDrops, 1)
+    return false
+  }
+  pacer.queue = append(pacer.queue, pkt)
+  return true
+}
+
+// Len returns packets waiting for tokens.
+func (pacer *Pacer) Len() int {
+  return len(pacer.queue)
+}
+
+func (pacer *Pacer) capacity() float64 {
+  limit := float64(pacer.rate) * PACE_BURST.Seconds()
+  if limit < float64(pacer.burst) {
+    limit = float64(pacer.burst)
+  }
+  return limit
+}
+
+func (pacer *Pacer) refill(now time.Time) {
+  if !pacer.last.IsZero() && now.After(pacer.last) {
+    pacer.tokens += float64(pacer.rate) * now.Sub(pacer.last).Seconds()
+  }
+  pacer.last = now
+  if limit := pacer.capacity(); pacer.tokens > limit {
+    pacer.tokens = limit
+  }
+}
+
+// Pop returns the packets which may be sent at now.
+func (pacer *Pacer) Pop(now time.Time) [][]byte {
+  pacer.refill(now)
+  if pacer.rate == 0 {
+    rslt := pacer.queue
+    pacer.queue = nil
+    return rslt
+  }
+  cnt := 0
+  for cnt < len(pacer.queue) && pacer.tokens >= float64(len(pacer.queue[cnt])) {
+    pacer.tokens -= float64(len(pacer.queue[cnt]))
+    cnt++
+  }
+  rslt := pacer.queue[:cnt:cnt]
+  pacer.queue = pacer.queue[cnt:]
+  return rslt
+}
+
+// Wait returns how long after the last Pop the next packet may go, 0
+// if nothing is waiting.
+func (pacer *Pacer) Wait() time.Duration {
+  if len(pacer.queue) == 0 || pacer.rate == 0 {
+    return 0
+  }
+  wait := time.Duration((float64(len(pacer.queue[0])) - pacer.tokens) / 
+    float64(pacer.rate) * float64(time.Second))
+  if wait < time.Microsecond {
+    wait = time.Microsecond
+  }
+  return wait
+}
@@ -0,0 +1,78 @@
+package kcp
+
+import (
+  "time"
+  "testing"
+)
+
+func TestPacer(t *testing.T) {
+  pacer := NewPacer(1000)
+  pacer.SetRate(100000)
+  for i := 0; i < 20; i++ {
+    pacer.Push(make([]byte, 1000))
+  }
+  now := time.Now()
+  if pkts := pacer.Pop(now); len(pkts) != 1 {
+    t.Fatalf("burst should allow 1 packet, got %d", len(pkts))
+  } else if wait := pacer.Wait(); wait < 9 * time.Millisecond || wait > 11 * time.Millisecond {
+    t.Errorf("1000 bytes at 100000 B/s should wait 10ms, got %v", wait)
+  }
+  
+  sent := 1
+  for i := 1; i <= 10; i++ {
+    sent += len(pacer.Pop(now.Add(time.Duration(i) * 10 * time.Millisecond)))
+  }
+  if sent != 11 {
+    t.Errorf("11 packets should be sent in 100ms, got %d", sent)
+  }
+  // idle time doesn't build up more than the burst
+  if pkts := pacer.Pop(now.Add(time.Second)); len(pkts) > 3 {
+    t.Errorf("burst exceeded after idle, %d packets", len(pkts))
+  }
+  
+  pacer.SetRate(0)
+  pacer.Pop(now.Add(2 * time.Second))
+  if pacer.Len() != 0 || pacer.Wait() != 0 {
+    t.Errorf("rate 0 should send every packet")
+  }
+}
+
+func TestPacingRate(t *testing.T) {
+  kcp := NewKCP(1, nil)
+  if kcp.PacingRate() != 0 {
+    t.Errorf("pacing rate without rtt")
+  }
+  kcp.update_ack(100)
+  kcp.WndSize(32, 128)
+  kcp.SetNoDelay(-1, -1, -1, 1)
+  want := uint32(32 * kcp.mtu * 10)
+  if rate := kcp.PacingRate(); rate < want || rate > want * 2 {
+    t.Errorf("pacing rate %d, expect about %d", rate, want)
+  }
+}
+
+func TestHold(t *testing.T) {
+  c2s, s2c := new(Loopback), new(Loopback)
+  ckcp, skcp := NewKCP(1, c2s.Write), NewKCP(1, s2c.Write)
+  skcp.Send([]byte("ping"))
+  skcp.Update(10)
+  skcp.Update(20)
+  s2c.deliver(ckcp)
+  
+  // a backlog in the pacer holds new data, the ack still goes
+  ckcp.Send([]byte("pong"))
+  ckcp.SetHold(true)
+  ckcp.Update(10)
+  ckcp.Update(20)
+  if ckcp.snd_nxt != 0 {
+    t.Errorf("held data sent, snd_nxt %d", ckcp.snd_nxt)
+  } else if len(c2s.pkts) != 1 || carries_data(c2s.pkts[0]) {
+    t.Errorf("ack not flushed alone while held, %d packets", len(c2s.pkts))
+  }
+  c2s.pkts = nil
+  ckcp.SetHold(false)
+  ckcp.Update(200)
+  if ckcp.snd_nxt != 1 || len(c2s.pkts) != 1 || !carries_data(c2s.pkts[0]) {
+    t.Errorf("data not sent once released, snd_nxt %d", ckcp.snd_nxt)
+  }
+}
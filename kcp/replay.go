@@ -0,0 +1,67 @@
+package kcp
+
+import (
+  "errors"
+  "sync/atomic"
+)
+
+const (
+  REPLAY_BLOCKS = 64
+  // a packet this many seqs behind the newest one is stale
+  REPLAY_WINDOW = (REPLAY_BLOCKS - 1) * 64
+  // a packet this many seqs ahead of the newest one is forged, no peer
+  // loses that many in a row
+  REPLAY_AHEAD = 1 << 20
+)
+
+var (
+  ErrReplay = errors.New("replayed packet")
+)
+
+// replay is a sliding window anti-replay filter over the seq of sealed
+// packets. It remembers the seqs in a ring of bit blocks up to
+// REPLAY_WINDOW behind the newest one, older ones are dropped as stale.
+// A seq is marked only after the session accepted its packet, so the
+// window moves with real traffic. Only the demon reading the socket uses
+// it.
+type replay struct {
+  top uint64
+  ring [REPLAY_BLOCKS]uint64
+}
+
+// check returns ErrReplay when seq was seen, is stale or too far ahead.
+func (r *replay) check(seq uint64) error {
+  if seq == 0 {
+    // a handshake packet, never one of the session
+    return ErrReplay
+  } else if seq + REPLAY_WINDOW < r.top {
+    atomic.AddUint64(&DefaultSnmp.ReplayStale, 1)
+    return ErrReplay
+  } else if seq > r.top + REPLAY_AHEAD {
+    atomic.AddUint64(&DefaultSnmp.ReplayAhead, 1)
+    return ErrReplay
+  } else if seq <= r.top && r.ring[seq / 64 % REPLAY_BLOCKS] & (uint64(1) << (seq % 64)) != 0 {
+    atomic.AddUint64(&DefaultSnmp.ReplayDups, 1)
+    return ErrReplay
+  }
+  return nil
+}
+
+// mark records seq as seen, the window moves ahead to it if it's the
+// newest. seq should have passed check.
+func (r *replay) mark(seq uint64) {
+  block := seq / 64
+  if seq > r.top {
+    // clear the blocks the window moves over
+    cur := r.top / 64
+    diff := block - cur
+    if diff > REPLAY_BLOCKS {
+      diff = REPLAY_BLOCKS
+    }
+    for i := cur + 1; i <= cur + diff; i++ {
+      r.ring[i % REPLAY_BLOCKS] = 0
+    }
+    r.top = seq
+  }
+  r.ring[block % REPLAY_BLOCKS] |= uint64(1) << (seq % 64)
+}
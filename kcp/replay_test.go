@@ -0,0 +1,100 @@
+package kcp
+
+import (
+  "testing"
+)
+
+func TestReplay(t *testing.T) {
+  r := new(replay)
+  pass := func(seq uint64) error {
+    if err := r.check(seq); err != nil {
+      return err
+    }
+    r.mark(seq)
+    return nil
+  }
+  for _, seq := range []uint64{1, 2, 5, 4, 3} {
+    if err := pass(seq); err != nil {
+      t.Errorf("seq %d dropped %v", seq, err)
+    }
+  }
+  snmp := DefaultSnmp.Copy()
+  for _, seq := range []uint64{0, 1, 4, 5} {
+    if err := pass(seq); err != ErrReplay {
+      t.Errorf("seq %d passes twice", seq)
+    }
+  }
+  if dups := DefaultSnmp.Copy().ReplayDups - snmp.ReplayDups; dups != 3 {
+    t.Errorf("%d duplicates counted, want 3", dups)
+  }
+
+  // late packets pass inside the window, stale ones never do
+  top := uint64(10 * REPLAY_WINDOW)
+  if err := pass(top); err != nil {
+    t.Errorf("jump ahead dropped %v", err)
+  } else if err := pass(top - REPLAY_WINDOW); err != nil {
+    t.Errorf("oldest seq in the window dropped %v", err)
+  } else if err := pass(top - REPLAY_WINDOW - 1); err != ErrReplay {
+    t.Errorf("stale seq passes")
+  } else if err := pass(6); err != ErrReplay {
+    t.Errorf("stale seq before the jump passes")
+  }
+  // blocks the window moved over are cleared, not left from the old round
+  for seq := top + 1; seq < top + 3 * REPLAY_WINDOW; seq += 37 {
+    if err := pass(seq); err != nil {
+      t.Fatalf("seq %d dropped after the window moved %v", seq, err)
+    }
+  }
+  if stale := DefaultSnmp.Copy().ReplayStale - snmp.ReplayStale; stale != 2 {
+    t.Errorf("%d stale counted, want 2", stale)
+  }
+  
+  // a seq too far ahead is dropped, the window stays with real traffic
+  last := r.top
+  if err := pass(last + REPLAY_AHEAD + 1); err != ErrReplay {
+    t.Errorf("seq far ahead passes")
+  } else if r.top != last || pass(last + 1) != nil {
+    t.Errorf("seq far ahead moved the window to %d", r.top)
+  } else if ahead := DefaultSnmp.Copy().ReplayAhead - snmp.ReplayAhead; ahead != 1 {
+    t.Errorf("%d ahead counted, want 1", ahead)
+  }
+}
+
+func TestReplaySession(t *testing.T) {
+  client, _ := NewCrypt("", "secret", true)
+  crypt, _ := NewCrypt("", "secret", false)
+  k := new(KDP)
+  k.crypt = crypt
+  k.init(1, nil, nil, nil)
+  defer k.terminate(0)
+
+  buffer := make([]byte, KCP_OVERHEAD + 4)
+  seg := &Segment{conv: 1, cmd: KCP_CMD_PUSH, wnd: 128, data: []byte("data")}
+  seg.Encode(buffer)
+  sealed := client.Seal(buffer, 1, 1)
+  for i := 0; i < 2; i++ {
+    seq, pkt, err := crypt.Open(append([]byte(nil), sealed...))
+    if err != nil {
+      t.Fatalf("open failed %v", err)
+    }
+    err = k.receive(seq, pkt)
+    if i == 0 && err != nil {
+      t.Errorf("first copy dropped %v", err)
+    } else if i == 1 && err != ErrReplay {
+      t.Errorf("replayed copy returns %v", err)
+    }
+  }
+  if size, err := k.kcp.PeekSize(); err != nil || size != 4 {
+    t.Errorf("received %d bytes %v", size, err)
+  }
+  
+  // a packet input refuses doesn't move the window
+  seg.conv = 2
+  seg.Encode(buffer)
+  seq, pkt, _ := crypt.Open(client.Seal(buffer, 1, 1000))
+  if err := k.receive(seq, pkt); err == nil {
+    t.Errorf("packet of another conv accepted")
+  } else if k.replay.top != 1 {
+    t.Errorf("refused packet moved the window to %d", k.replay.top)
+  }
+}
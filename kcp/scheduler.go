@@ -0,0 +1,155 @@
+package kcp
+
+import (
+  "sync"
+  "time"
+  "container/heap"
+)
+
+// job is a session in the scheduler, run returns when it's due again, a
+// zero time drops it.
+type job struct {
+  run func(time.Time) time.Time
+  due time.Time
+  slot int
+}
+
+func new_job(run func(time.Time) time.Time) *job {
+  return &job{run: run, slot: -1}
+}
+
+// job_heap orders jobs by due time, slot tracks the index of each job.
+type job_heap []*job
+
+func (h job_heap) Len() int { return len(h) }
+func (h job_heap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+
+func (h job_heap) Swap(i, j int) {
+  h[i], h[j] = h[j], h[i]
+  h[i].slot, h[j].slot = i, j
+}
+
+func (h *job_heap) Push(x interface{}) {
+  j := x.(*job)
+  j.slot = len(*h)
+  *h = append(*h, j)
+}
+
+func (h *job_heap) Pop() interface{} {
+  old := *h
+  j := old[len(old) - 1]
+  old[len(old) - 1] = nil
+  *h = old[:len(old) - 1]
+  j.slot = -1
+  return j
+}
+
+// scheduler runs the jobs of many sessions from one goroutine, each one
+// at the time its kcp asks for instead of polling them all.
+type scheduler struct {
+  lock sync.Mutex
+  jobs job_heap
+  wake chan bool
+  die chan bool
+  stopped bool
+}
+
+func new_scheduler() *scheduler {
+  sched := new(scheduler)
+  sched.init()
+  go sched.demon()
+  return sched
+}
+
+func (sched *scheduler) init() {
+  sched.wake = make(chan bool, 1)
+  sched.die = make(chan bool)
+}
+
+
+// schedule runs j at the given time, a pending run of j that is due
+// earlier is kept.
+func (sched *scheduler) schedule(j *job, at time.Time) {
+  sched.lock.Lock()
+  defer sched.lock.Unlock()
+  if j.slot < 0 {
+    j.due = at
+    heap.Push(&sched.jobs, j)
+  } else if at.Before(j.due) {
+    j.due = at
+    heap.Fix(&sched.jobs, j.slot)
+  } else {
+    return
+  }
+  if j.slot == 0 {
+    select {
+    case sched.wake <- true:
+    default:
+    }
+  }
+}
+
+func (sched *scheduler) remove(j *job) {
+  sched.lock.Lock()
+  defer sched.lock.Unlock()
+  if j.slot >= 0 {
+    heap.Remove(&sched.jobs, j.slot)
+  }
+}
+
+func (sched *scheduler) stop() {
+  sched.lock.Lock()
+  defer sched.lock.Unlock()
+  if !sched.stopped {
+    sched.stopped = true
+    close(sched.die)
+  }
+}
+
+// run_due runs the jobs due at now, and returns how long until the next
+// one is.
+func (sched *scheduler) run_due(now time.Time) time.Duration {
+  var due []*job
+  sched.lock.Lock()
+  for len(sched.jobs) > 0 && !sched.jobs[0].due.After(now) {
+    due = append(due, heap.Pop(&sched.jobs).(*job))
+  }
+  sched.lock.Unlock()
+
+  // jobs run without the lock, they may schedule or remove themselves
+  for _, j := range due {
+    if next := j.run(now); !next.IsZero() {
+      sched.schedule(j, next)
+    }
+  }
+
+  sched.lock.Lock()
+  defer sched.lock.Unlock()
+  if len(sched.jobs) == 0 {
+    return time.Hour
+  }
+  return sched.jobs[0].due.Sub(time.Now())
+}
+
+func (sched *scheduler) demon() {
+  timer := time.NewTimer(time.Hour)
+  defer timer.Stop()
+  for {
+    wait := sched.run_due(time.Now())
+    if wait <= 0 {
+      select {
+      case <- sched.die:
+        return
+      default:
+        continue
+      }
+    }
+    timer.Reset(wait)
+    select {
+    case <- timer.C:
+    case <- sched.wake:
+    case <- sched.die:
+      return
+    }
+  }
+}
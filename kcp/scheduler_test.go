@@ -0,0 +1,88 @@
+package kcp
+
+import (
+  "net"
+  "time"
+  "testing"
+)
+
+func TestScheduler(t *testing.T) {
+  sched := new(scheduler)
+  sched.init()
+  now := time.Now()
+  var order []int
+  jobs := make([]*job, 3)
+  for i := range jobs {
+    id := i
+    jobs[i] = new_job(func(time.Time) time.Time {
+      order = append(order, id)
+      return time.Time{}
+    })
+  }
+  sched.schedule(jobs[0], now.Add(30 * time.Millisecond))
+  sched.schedule(jobs[1], now.Add(10 * time.Millisecond))
+  sched.schedule(jobs[2], now.Add(20 * time.Millisecond))
+  // a later time doesn't delay the pending run, an earlier one moves it
+  sched.schedule(jobs[1], now.Add(time.Second))
+  sched.schedule(jobs[0], now.Add(5 * time.Millisecond))
+
+  if wait := sched.run_due(now); wait <= 0 || wait > 5 * time.Millisecond {
+    t.Errorf("first job due in %v, want 5ms", wait)
+  } else if len(order) != 0 {
+    t.Errorf("jobs %v run too early", order)
+  }
+  sched.run_due(now.Add(15 * time.Millisecond))
+  if len(order) != 2 || order[0] != 0 || order[1] != 1 {
+    t.Errorf("jobs run in order %v, want [0 1]", order)
+  }
+  sched.remove(jobs[2])
+  if sched.run_due(now.Add(time.Minute)); len(order) != 2 {
+    t.Errorf("removed job run, order %v", order)
+  }
+
+  runs := 0
+  again := new_job(func(at time.Time) time.Time {
+    runs++
+    return at.Add(10 * time.Millisecond)
+  })
+  sched.schedule(again, now)
+  for i := 0; i < 5; i++ {
+    sched.run_due(now.Add(time.Duration(i) * 10 * time.Millisecond))
+  }
+  if runs != 5 {
+    t.Errorf("rescheduled job run %d times, want 5", runs)
+  }
+}
+
+// BenchmarkIdleSessions runs one round of updates over 10k idle sessions
+// sharing a scheduler, as a server with that many clients does every
+// flush interval.
+func BenchmarkIdleSessions(b *testing.B) {
+  const sessions = 10000
+  udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+  if err != nil {
+    b.Fatalf("listen failed %v", err)
+  }
+  defer udp.Close()
+  raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+  config := DefaultConfig()
+  config.KeepAlive, config.IdleTimeout = -1, -1
+  sched := new(scheduler)
+  sched.init()
+  for i := 0; i < sessions; i++ {
+    k := new(KDP)
+    k.sched = sched
+    k.init(uint32(i + 1), udp, raddr, config)
+  }
+
+  // every round moves the clock one flush interval on, so each session
+  // is due and kcp, which runs at the time the scheduler passes, flushes
+  now := time.Now()
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    now = now.Add(KDP_INTERVAL)
+    sched.run_due(now)
+  }
+  b.ReportMetric(float64(b.Elapsed().Nanoseconds()) / float64(b.N * sessions), "ns/session")
+}
@@ -0,0 +1,127 @@
+package kcp
+
+import (
+  "fmt"
+  "reflect"
+  "sync/atomic"
+)
+
+// Stats is a snapshot of one session, counters are totals since the
+// session was created.
+type Stats struct {
+  BytesSent      uint64 `desc:"bytes handed to the output, acks and retransmissions included"`
+  BytesRecv      uint64 `desc:"bytes passed to Input"`
+  SegsSent       uint64 `desc:"data segments sent, retransmissions included"`
+  SegsRecv       uint64 `desc:"data segments received, duplicates included"`
+  TimeoutRetrans uint64 `desc:"segments resent after rto"`
+  FastRetrans    uint64 `desc:"segments resent after out of order acks"`
+  Duplicates     uint64 `desc:"data segments received more than once or outside the window"`
+  InErrs         uint64 `desc:"packets Input rejected"`
+  Srtt           uint32 `desc:"smoothed rtt in millisec"`
+  Rttvar         uint32 `desc:"rtt variation in millisec"`
+  Rto            uint32 `desc:"retransmission timeout in millisec"`
+  Cwnd           uint32 `desc:"segments allowed in flight"`
+  Ssthresh       uint32 `desc:"slow start threshold, 0 if the controller has none"`
+  RmtWnd         uint32 `desc:"receive window of remote side in segments"`
+  SndQueue       uint32 `desc:"segments waiting for the window"`
+  SndBuf         uint32 `desc:"segments sent but not acked"`
+  RcvQueue       uint32 `desc:"segments ready for Recv"`
+  RcvBuf         uint32 `desc:"segments received out of order"`
+}
+
+func (stats *Stats) String() string {
+  return fmt.Sprintf("sent %d/%d recv %d/%d retrans %d/%d dup %d srtt %d rto %d cwnd %d queue %d/%d/%d/%d",
+    stats.SegsSent, stats.BytesSent, stats.SegsRecv, stats.BytesRecv, stats.TimeoutRetrans,
+    stats.FastRetrans, stats.Duplicates, stats.Srtt, stats.Rto, stats.Cwnd,
+    stats.SndQueue, stats.SndBuf, stats.RcvQueue, stats.RcvBuf)
+}
+
+// Snmp holds counters of all sessions in the process, each field is
+// updated atomically.
+type Snmp struct {
+  BytesSent      uint64 `desc:"bytes handed to the output by all sessions"`
+  BytesRecv      uint64 `desc:"bytes passed to Input of all sessions"`
+  SegsSent       uint64 `desc:"data segments sent"`
+  SegsRecv       uint64 `desc:"data segments received"`
+  TimeoutRetrans uint64 `desc:"segments resent after rto"`
+  FastRetrans    uint64 `desc:"segments resent after out of order acks"`
+  Duplicates     uint64 `desc:"duplicated data segments received"`
+  InErrs         uint64 `desc:"packets Input rejected"`
+  FecRecovered   uint64 `desc:"packets restored from fec parity"`
+  PacerDrops     uint64 `desc:"packets dropped by a full pacer queue"`
+  AuthErrs       uint64 `desc:"packets dropped because they failed authentication"`
+  PeerRefused    uint64 `desc:"handshakes refused because the peer identity isn't known"`
+  ReplayDups     uint64 `desc:"sealed packets dropped because their seq was seen before"`
+  ReplayStale    uint64 `desc:"sealed packets dropped because their seq fell behind the anti-replay window"`
+  ReplayAhead    uint64 `desc:"sealed packets dropped because their seq is too far ahead of the anti-replay window"`
+  Migrations     uint64 `desc:"sessions moved to a new client address"`
+  ReapDrops      uint64 `desc:"removed sessions not reported because Reaped was full"`
+}
+
+// DefaultSnmp collects counters of every session.
+var DefaultSnmp = new(Snmp)
+
+func (snmp *Snmp) fields() []*uint64 {
+  value := reflect.ValueOf(snmp).Elem()
+  rslt := make([]*uint64, value.NumField())
+  for i := range rslt {
+    rslt[i] = value.Field(i).Addr().Interface().(*uint64)
+  }
+  return rslt
+}
+
+// Copy returns a snapshot of snmp.
+func (snmp *Snmp) Copy() *Snmp {
+  rslt := new(Snmp)
+  dest := rslt.fields()
+  for i, field := range snmp.fields() {
+    *dest[i] = atomic.LoadUint64(field)
+  }
+  return rslt
+}
+
+// Reset sets every counter to 0.
+func (snmp *Snmp) Reset() {
+  for _, field := range snmp.fields() {
+    atomic.StoreUint64(field, 0)
+  }
+}
+
+// Header returns the field names in the order of ToSlice.
+func (snmp *Snmp) Header() []string {
+  kind := reflect.TypeOf(snmp).Elem()
+  rslt := make([]string, kind.NumField())
+  for i := range rslt {
+    rslt[i] = kind.Field(i).Name
+  }
+  return rslt
+}
+
+// ToSlice returns the counters as strings, for csv output.
+func (snmp *Snmp) ToSlice() []string {
+  fields := snmp.Copy().fields()
+  rslt := make([]string, len(fields))
+  for i, field := range fields {
+    rslt[i] = fmt.Sprint(*field)
+  }
+  return rslt
+}
+
+// count adds delta to a session counter and its process wide one
+func count(field *uint64, global *uint64, delta uint64) {
+  *field += delta
+  atomic.AddUint64(global, delta)
+}
+
+// Stats returns a snapshot of the counters and the current state.
+func (kcp *KCP) Stats() *Stats {
+  stats := kcp.stats
+  stats.Srtt, stats.Rttvar, stats.Rto = kcp.rx_srtt, kcp.rx_rttval, kcp.rx_rto
+  stats.Cwnd, stats.RmtWnd = kcp.cwnd(), kcp.rmt_wnd
+  if reno, ok := kcp.cc.(interface{ Ssthresh() uint32 }); ok {
+    stats.Ssthresh = reno.Ssthresh()
+  }
+  stats.SndQueue, stats.SndBuf = kcp.snd_queue.Len(), kcp.snd_buf.Len()
+  stats.RcvQueue, stats.RcvBuf = kcp.rcv_queue.Len(), kcp.rcv_buf.Len()
+  return &stats
+}
@@ -0,0 +1,67 @@
+package kcp
+
+import (
+  "testing"
+)
+
+func TestStats(t *testing.T) {
+  DefaultSnmp.Reset()
+  c2s := &Loopback{lose: func(cnt int) bool { return cnt >= 3 && cnt <= 7 }}
+  s2c := new(Loopback)
+  ckcp, skcp := NewKCP(7, c2s.Write), NewKCP(7, s2c.Write)
+  for _, kcp := range []*KCP{ckcp, skcp} {
+    kcp.SetNoDelay(1, 10, 2, 1)
+    kcp.WndSize(64, 64)
+  }
+  
+  total, recved := 20, 0
+  for i := 0; i < total; i++ {
+    ckcp.Send(make([]byte, 1000))
+  }
+  buffer, first := make([]byte, 1000), []byte(nil)
+  var current uint32
+  for i := 0; i < 1000 && recved < total; i++ {
+    current += 10
+    ckcp.Update(current)
+    skcp.Update(current)
+    if first == nil && len(c2s.pkts) > 0 {
+      first = c2s.pkts[0]
+    }
+    c2s.deliver(skcp)
+    s2c.deliver(ckcp)
+    for {
+      if _, err := skcp.Recv(buffer); err != nil {
+        break
+      }
+      recved++
+    }
+  }
+  skcp.Input(first)
+  skcp.Input([]byte{1})
+  
+  sent, rcvd := ckcp.Stats(), skcp.Stats()
+  if sent.SegsSent != uint64(c2s.cnt) || sent.BytesSent != uint64(c2s.bytes) {
+    t.Errorf("sent %d/%d, expect %d/%d", sent.SegsSent, sent.BytesSent, c2s.cnt, c2s.bytes)
+  } else if sent.FastRetrans + sent.TimeoutRetrans != uint64(c2s.cnt - total) {
+    t.Errorf("retrans %d/%d, expect %d", sent.FastRetrans, sent.TimeoutRetrans, c2s.cnt - total)
+  } else if sent.FastRetrans == 0 {
+    t.Errorf("fast retrans not counted")
+  } else if rcvd.SegsRecv != uint64(total - 5 + int(sent.FastRetrans + sent.TimeoutRetrans) + 1) {
+    t.Errorf("received %d segments", rcvd.SegsRecv)
+  } else if rcvd.Duplicates != 1 || rcvd.InErrs != 1 {
+    t.Errorf("duplicates %d errors %d, expect 1/1", rcvd.Duplicates, rcvd.InErrs)
+  } else if sent.Srtt == 0 || sent.Rto == 0 || sent.RmtWnd == 0 || sent.Cwnd == 0 {
+    t.Errorf("state not reported %v", sent)
+  }
+  
+  snmp := DefaultSnmp.Copy()
+  if snmp.SegsSent < sent.SegsSent || snmp.Duplicates < 1 || snmp.InErrs < 1 {
+    t.Errorf("snmp not updated %v", snmp.ToSlice())
+  } else if len(snmp.Header()) != len(snmp.ToSlice()) {
+    t.Errorf("snmp header not match")
+  }
+  DefaultSnmp.Reset()
+  if DefaultSnmp.Copy().SegsSent != 0 {
+    t.Errorf("snmp not reset")
+  }
+}
@@ -1,27 +1,39 @@
 package kcp
 
 import (
+  "context"
+  "os"
   "net"
+  "sync"
   "time"
   "errors"
+  "sync/atomic"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/binary"
 )
 
 const (
   SERVER_ADDR = "0.0.0.0:10878"
   KDP_INTERVAL = 10 * time.Millisecond
+  // removed sessions Reaped holds
+  KDP_REAPED = 1024
 )
 
 const (
   KDP_CLOSE = iota
-  KDP_READ
-  KDP_WRITE
-  KDP_INPUT
   KDP_BREAK
+  KDP_STATS
 )
 
+// clock returns current time in millisec, it wraps every ~49 days and
+// must only be compared through timediff.
 func clock() uint32 {
-  Now := time.Now().UnixNano()
-  return uint32(Now / 1000000) & 0xFFFFFFFF
+  return clock_at(time.Now())
+}
+
+func clock_at(now time.Time) uint32 {
+  return uint32(now.UnixNano() / 1000000)
 }
 
 type cmd struct {
@@ -35,284 +47,675 @@ type reply struct {
   rslt []interface{}
 }
 
+// KDP is a kcp session over udp. Callers use the kcp state under lock,
+// the scheduler updates kcp at the time Check returns. Sessions of a
+// Server share its scheduler, others have their own.
 type KDP struct {
+  lock sync.Mutex
   udp *net.UDPConn
   kcp *KCP
   buff []byte
   raddr *net.UDPAddr
-  update bool
-  updated chan bool
+  crypt *Crypt
+  // seq of the last sealed packet sent, replay filters the received ones
+  seq uint64
+  replay replay
+  // address a move is being confirmed at and when it was probed, only
+  // the demon of Server uses them
+  path *net.UDPAddr
+  path_probe time.Time
+  // shifts the kcp clock, tests move it close to 2^32
+  clock_offset uint32
   close bool
-  event chan *cmd
-  arrived chan bool
+  // readable and writable are closed to wake the waiting Read and Write,
+  // die once the session is closed
+  readable, writable, die chan bool
+  // acked is closed to wake Flush when acks arrive
+  acked chan bool
+  rd_waiting, wr_waiting, ack_waiting bool
+  sched *scheduler
+  own_sched bool
+  job *job
+  fec_enc *FecEncoder
+  fec_dec *FecDecoder
+  pacer *Pacer
+  bandwidth uint32
+  linger time.Duration
+  closing bool
+  linger_until time.Time
+  idle uint32
+  snd_limit, snd_segs int
+  fault error
+  notified bool
+  on_done func(*KDP)
+  deadline
 }
 
-func NewKDP(conv uint32, udp *net.UDPConn, raddr *net.UDPAddr) *KDP {
+func NewKDP(conv uint32, udp *net.UDPConn, raddr *net.UDPAddr, config *Config) *KDP {
   k := new(KDP)
-  k.init(conv, udp, raddr)
+  k.init(conv, udp, raddr, config)
   return k
 }
 
-func (k *KDP) init(conv uint32, udp *net.UDPConn, raddr *net.UDPAddr) {
+func (k *KDP) init(conv uint32, udp *net.UDPConn, raddr *net.UDPAddr, config *Config) {
   k.udp = udp
   k.raddr = raddr
   k.kcp = NewKCP(conv, k.output)
-  k.event = make(chan *cmd)
-  k.arrived = make(chan bool)
-  k.updated = make(chan bool)
-  k.kcp.set_nodelay(1, 10, 2, 1)
-  go k.demon()
+  k.deadline.init()
+  k.readable = make(chan bool)
+  k.writable = make(chan bool)
+  k.acked = make(chan bool)
+  k.die = make(chan bool)
+  if config == nil {
+    config = DefaultConfig()
+  }
+  config.apply(k.kcp)
+  k.clock_offset = config.clock_offset
+  if k.crypt == nil {
+    // the key is checked by Validate, sessions of NewKDP take the
+    // client side
+    k.crypt, _ = config.crypt(true)
+  }
+  k.linger = config.linger()
+  k.idle = uint32(config.idle())
+  k.snd_limit, k.snd_segs = config.send_limit()
+  if config.fec() {
+    // shard counts are checked by Validate
+    k.fec_enc, _ = NewFecEncoder(config.DataShards, config.ParityShards)
+    k.fec_dec, _ = NewFecDecoder(config.DataShards, config.ParityShards)
+  }
+  if config.pacing() {
+    k.pacer = NewPacer(KCP_MTU_MAX)
+    k.bandwidth = uint32(config.Bandwidth)
+  }
+  if k.sched == nil {
+    k.sched, k.own_sched = new_scheduler(), true
+  }
+  k.job = new_job(k.run)
+  k.sched.schedule(k.job, time.Now())
 }
 
 func (k *KDP) output(data []byte) (int, error) {
-  return k.udp.WriteToUDP(data, k.raddr)
+  if k.fec_enc == nil && k.pacer == nil {
+    return k.send(data)
+  }
+  pkts := [][]byte{data}
+  if k.fec_enc != nil {
+    pkts = k.fec_enc.Encode(data)
+  } else {
+    // kcp reuses data once output returns
+    pkts[0] = append([]byte(nil), data...)
+  }
+  // only data waits for the pacer, acks and probes go at once
+  paced := k.pacer != nil && carries_data(data)
+  for _, pkt := range pkts {
+    if paced {
+      k.pacer.Push(pkt)
+    } else if _, err := k.send(pkt); err != nil {
+      return 0, err
+    }
+  }
+  return len(data), nil
+}
+
+// carries_data reports whether a packet kcp output has a PUSH segment
+func carries_data(pkt []byte) bool {
+  for len(pkt) >= KCP_OVERHEAD {
+    if binary.LittleEndian.Uint32(pkt[12:]) == KCP_CMD_PUSH {
+      return true
+    }
+    size := KCP_OVERHEAD + int(binary.LittleEndian.Uint32(pkt[28:]))
+    if size > len(pkt) {
+      break
+    }
+    pkt = pkt[size:]
+  }
+  return false
+}
+
+// pace sends the packets the pacer allows now, and returns how long
+// until the next one may go, 0 if none is waiting.
+func (k *KDP) pace(now time.Time) time.Duration {
+  for _, pkt := range k.pacer.Pop(now) {
+    k.send(pkt)
+  }
+  return k.pacer.Wait()
+}
+
+// send writes one packet to the peer, sealed when the session has a key.
+func (k *KDP) send(pkt []byte) (int, error) {
+  return k.send_to(pkt, k.raddr)
+}
+
+func (k *KDP) send_to(pkt []byte, raddr *net.UDPAddr) (int, error) {
+  if k.crypt == nil {
+    return k.udp.WriteToUDP(pkt, raddr)
+  }
+  k.seq++
+  _, err := k.udp.WriteToUDP(k.crypt.Seal(pkt, k.kcp.conv, k.seq), raddr)
+  return len(pkt), err
+}
+
+// probe sends a PING to raddr outside of the arq, the peer answers it
+// with a PONG from where it is.
+func (k *KDP) probe(raddr *net.UDPAddr) {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  seg := NewSegment(k.kcp)
+  seg.cmd, seg.una, seg.wnd = KCP_CMD_PING, k.kcp.rcv_nxt, k.kcp.wnd_unused()
+  buffer := make([]byte, KCP_OVERHEAD)
+  seg.Encode(buffer)
+  pkts := [][]byte{buffer}
+  if k.fec_enc != nil {
+    pkts = k.fec_enc.Encode(buffer)
+  }
+  for _, pkt := range pkts {
+    k.send_to(pkt, raddr)
+  }
+}
+
+// pongs returns how many PONGs kcp received so far.
+func (k *KDP) pongs() uint32 {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  return k.kcp.pongs
+}
+
+// move sends to raddr from now on, and returns the address before.
+func (k *KDP) move(raddr *net.UDPAddr) *net.UDPAddr {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  old := k.raddr
+  k.raddr = raddr
+  return old
 }
 
-func (k *KDP) Sync() {
-  for k.kcp.snd_buf.Len() + k.kcp.snd_queue.Len() > 0 {
-  <-time.After(500 * time.Millisecond)
+// receive passes a packet opened by the session crypt to input, unless
+// the anti-replay filter drops it. Its seq is marked seen once input
+// accepts it. Only the demon reading the socket calls it.
+func (k *KDP) receive(seq uint64, pkt []byte) error {
+  if k.crypt == nil {
+    return k.input(pkt)
+  } else if err := k.replay.check(seq); err != nil {
+    return err
+  } else if err := k.input(pkt); err != nil {
+    return err
   }
+  k.replay.mark(seq)
+  return nil
+}
+
+func (k *KDP) pacing_rate() uint32 {
+  rate := k.kcp.PacingRate()
+  if k.bandwidth > 0 && (rate == 0 || rate > k.bandwidth) {
+    rate = k.bandwidth
+  }
+  return rate
+}
+
+// Flush waits until the peer acked everything written so far. It fails
+// with the error of a failed or closed session, or ctx.Err() once ctx is
+// done.
+func (k *KDP) Flush(ctx context.Context) error {
+  k.lock.Lock()
+  mark := k.kcp.SendMark()
+  k.notify_update()
+  k.lock.Unlock()
+  for {
+    acked, err := k.flush_once(ctx, mark)
+    if acked == nil {
+      return err
+    }
+    select {
+    case <- acked:
+    case <- ctx.Done():
+    }
+  }
+}
+
+// flush_once checks whether mark was acked, or returns the channel
+// closed when more acks arrive.
+func (k *KDP) flush_once(ctx context.Context, mark uint32) (chan bool, error) {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  if k.kcp.Acked(mark) {
+    return nil, nil
+  } else if k.fault != nil {
+    return nil, k.fault
+  } else if k.close {
+    return nil, errors.New("kdp closed")
+  } else if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  k.ack_waiting = true
+  return k.acked, nil
 }
 
 func (k *KDP) Read(store []byte) (int, error) {
+  return k.ReadContext(context.Background(), store)
+}
+
+// ReadContext is Read returning ctx.Err() once ctx is done.
+func (k *KDP) ReadContext(ctx context.Context, store []byte) (int, error) {
   if len(store) == 0 {
     return 0, errors.New("store size less than 1")
   }
   
-  for !k.close {
-    if len(k.buff) > 0 {
-      cnt := copy(store, k.buff)
-      if cnt < len(k.buff) {
-        k.buff = k.buff[cnt:]
-      } else {
-        k.buff = nil
-      }
-      return cnt, nil
+  for {
+    cnt, readable, err := k.read_once(ctx, store)
+    if readable == nil {
+      return cnt, err
     }
-    if data, err := k.read_once(); err != nil {
-    } else {
-      cnt := copy(store, data)
-      if cnt < len(data) {
-        k.buff = data[cnt:]
-      }
-      return cnt, nil
+    // readable is closed once a message arrives, so one arriving after
+    // read_once is not missed
+    var expire <-chan time.Time
+    timer := k.read_timer()
+    if timer != nil {
+      expire = timer.C
     }
     select {
-    case <- time.After(1 * time.Second):
-    case <- k.arrived:
-    } 
+    case <- readable:
+    case <- expire:
+    case <- k.rd_wake:
+    case <- ctx.Done():
+    }
+    if timer != nil {
+      timer.Stop()
+    }
   }
-  return 0, errors.New("client closed")
 }
 
-func (k *KDP) read_once() ([]byte, error) {
-  defer recover()
-  if k.close {
-    return nil, errors.New("kdp closed")
+// read_once copies the next message into store, or returns the channel
+// closed when it arrives.
+func (k *KDP) read_once(ctx context.Context, store []byte) (int, chan bool, error) {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  if len(k.buff) > 0 {
+    cnt := copy(store, k.buff)
+    if cnt < len(k.buff) {
+      k.buff = k.buff[cnt:]
+    } else {
+      k.buff = nil
+    }
+    return cnt, nil, nil
+  } else if k.close && k.fault != nil {
+    return 0, nil, k.fault
+  } else if k.close {
+    return 0, nil, errors.New("kdp closed")
+  } else if k.read_expired() {
+    return 0, nil, os.ErrDeadlineExceeded
+  } else if err := ctx.Err(); err != nil {
+    return 0, nil, err
   }
-  flow := make(chan *reply)
-  defer close(flow)
-  action := new(cmd)
-  action.cmd = KDP_READ
-  action.pipe = flow
   
-  k.event <- action
-  rslt := <- flow
-  if rslt.err != nil {
-    return nil, rslt.err
-  } 
-  data := rslt.rslt[0].([]byte)
-  return data, nil
-}
-
-func (k *KDP) Write(data []byte) error {
-  defer recover()
-  if data == nil || len(data) == 0 {
-    return nil
+  size, err := k.kcp.PeekSize()
+  if err == ErrNoData && k.fault != nil {
+    return 0, nil, k.fault
+  } else if err == ErrNoData {
+    k.rd_waiting = true
+    return 0, k.readable, nil
+  } else if err != nil {
+    return 0, nil, err
+  }
+  // in stream mode more than one segment may be merged into data
+  if k.kcp.stream && len(store) > size {
+    size = len(store)
+  }
+  data := store
+  if size > len(store) {
+    data = make([]byte, size)
+  }
+  size, err = k.kcp.Recv(data)
+  // the window may have opened, tell the remote side soon
+  k.notify_update()
+  if err != nil {
+    return 0, nil, err
+  }
+  cnt := copy(store, data[:size])
+  if cnt < size {
+    k.buff = data[cnt:size]
+  }
+  return cnt, nil, nil
+}
+
+// Write queues data for sending, it's copied so the caller may reuse it.
+func (k *KDP) Write(data []byte) (int, error) {
+  return k.WriteContext(context.Background(), data)
+}
+
+// WriteContext is Write giving up once ctx is done. It blocks while the
+// send buffer is full.
+func (k *KDP) WriteContext(ctx context.Context, data []byte) (int, error) {
+  for {
+    cnt, writable, err := k.try_write(ctx, data)
+    if writable == nil {
+      return cnt, err
+    }
+    var expire <-chan time.Time
+    timer := k.write_timer()
+    if timer != nil {
+      expire = timer.C
+    }
+    select {
+    case <- writable:
+    case <- expire:
+    case <- k.wd_wake:
+    case <- ctx.Done():
+    }
+    if timer != nil {
+      timer.Stop()
+    }
+  }
+}
+
+// TryWrite is Write returning ErrWouldBlock instead of blocking.
+func (k *KDP) TryWrite(data []byte) (int, error) {
+  cnt, writable, err := k.try_write(context.Background(), data)
+  if writable != nil {
+    return 0, ErrWouldBlock
+  }
+  return cnt, err
+}
+
+// try_write queues data, or returns the channel closed once the send
+// buffer takes more.
+func (k *KDP) try_write(ctx context.Context, data []byte) (int, chan bool, error) {
+  if len(data) == 0 {
+    return 0, nil, nil
+  }
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  if k.close && k.fault != nil {
+    return 0, nil, k.fault
   } else if k.close {
+    return 0, nil, errors.New("kdp closed")
+  } else if k.fault != nil {
+    return 0, nil, k.fault
+  } else if k.write_expired() {
+    return 0, nil, os.ErrDeadlineExceeded
+  } else if err := ctx.Err(); err != nil {
+    return 0, nil, err
+  } else if !k.can_write() {
+    k.wr_waiting = true
+    return 0, k.writable, nil
+  } else if err := k.kcp.Send(data); err != nil {
+    return 0, nil, err
+  }
+  k.notify_update()
+  return len(data), nil, nil
+}
+
+// can_write tells whether the send buffer takes more data, a write may
+// go over the limit so data larger than it still gets through.
+func (k *KDP) can_write() bool {
+  if k.snd_limit > 0 && k.kcp.WaitSndBytes() >= k.snd_limit {
+    return false
+  }
+  return k.snd_segs == 0 || k.kcp.WaitSnd() < k.snd_segs
+}
+
+// Close waits up to the configured linger until all data sent and the
+// FIN after it are acked, then releases the session. The remote side
+// doesn't have to close as well.
+func (k *KDP) Close() error {
+  k.lock.Lock()
+  closed := k.close
+  k.lock.Unlock()
+  if closed {
     return errors.New("kdp closed")
   }
-  for true {
-    //select {
-    //case <-k.updated:
-    //case <-time.After(time.Second):
-    //}
-    //if k.kcp.snd_queue.Len() > 0 {
-    //  continue
-    //}
-    flow := make(chan *reply)
-    defer close(flow)
-    action := new(cmd)
-    action.cmd = KDP_WRITE
-    action.pipe = flow
-    action.args = []interface{}{data}
-    k.event <- action
-    rslt := <- flow
-    if rslt.err != nil {
-      return rslt.err
-    }
-    return nil
+  k.terminate(k.linger)
+  return nil
+}
+
+// terminate closes the session once the FIN is acked or linger expired,
+// without linger it's closed at once.
+func (k *KDP) terminate(linger time.Duration) {
+  k.lock.Lock()
+  if k.close {
+  } else if linger <= 0 || k.kcp.Drained() {
+    k.finish_close()
+  } else if !k.closing {
+    // run finishes the close
+    k.kcp.CloseWrite()
+    k.closing = true
+    k.linger_until = time.Now().Add(linger)
+    k.notify_update()
+  }
+  k.lock.Unlock()
+  <- k.die
+}
+
+// CloseWrite sends FIN after the queued data, the remote side reads
+// io.EOF then. Reading from this side still works.
+func (k *KDP) CloseWrite() error {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  if k.close {
+    return errors.New("kdp closed")
   }
+  k.kcp.CloseWrite()
+  k.notify_update()
   return nil
 }
 
-func (k *KDP) Close() {
-  defer recover()
+// Stats returns a snapshot of the session counters and state.
+func (k *KDP) Stats() (*Stats, error) {
+  k.lock.Lock()
+  defer k.lock.Unlock()
   if k.close {
-    return
+    return nil, errors.New("kdp closed")
   }
-  k.close = true
-  action := new(cmd)
-  action.cmd = KDP_CLOSE
-  action.pipe = make(chan *reply)
-  k.event <- action
-  <- action.pipe
+  return k.kcp.Stats(), nil
+}
+
+// Err returns why the session failed, ErrDeadLink or ErrIdleTimeout, nil
+// if it didn't.
+func (k *KDP) Err() error {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  return k.fault
 }
 
 func (k *KDP) input(data []byte) error {
-  defer recover()
-  if data == nil || len(data) == 0 {
+  if len(data) == 0 {
     return nil
-  } else if k.close {
+  }
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  if k.close {
     return errors.New("kdp closed")
   }
-  flow := make(chan *reply)
-  defer close(flow)
-  action := new(cmd)
-  action.cmd = KDP_INPUT
-  action.pipe = flow
-  action.args = []interface{}{data}
-  k.event <- action
-  rslt := <- flow
-  if rslt.err != nil {
-    return rslt.err
-  } else {
-    select {
-    case k.arrived <- true:
-    default:
-    }
-    return nil
+  mark := k.kcp.snd_una
+  err := k.kcp_input(data)
+  if k.ack_waiting && k.kcp.snd_una != mark {
+    k.wake_flushes()
   }
+  if _, perr := k.kcp.PeekSize(); perr != ErrNoData && k.rd_waiting {
+    k.wake_readers()
+  }
+  // acks may have freed the send buffer
+  if k.wr_waiting && k.can_write() {
+    k.wake_writers()
+  }
+  k.notify_update()
+  return err
 }
 
-func (k *KDP) execute(action *cmd) {
-  defer recover()
-  switch action.cmd {
-  case KDP_READ:
-    k.execute_read(action)
-  case KDP_WRITE:
-    k.execute_write(action)
-  case KDP_INPUT:
-    k.execute_input(action)
-  case KDP_CLOSE:
-    k.execute_close(action)
-  default:
-    k.unknown_action(action)
+func (k *KDP) kcp_input(data []byte) error {
+  if k.fec_dec == nil {
+    return k.kcp.Input(data)
   }
+  pkts, err := k.fec_dec.Decode(data)
+  if err != nil {
+    return err
+  }
+  for _, pkt := range pkts {
+    if err := k.kcp.Input(pkt); err != nil {
+      return err
+    }
+  }
+  return nil
 }
 
-func (k *KDP) execute_close(action *cmd) {
-  close(k.event)
-  close(k.arrived)
-  go snd_rslt(nil, action.pipe)
+func (k *KDP) finish_close() {
+  k.close = true
+  k.sched.remove(k.job)
+  if k.own_sched {
+    k.sched.stop()
+  }
+  close(k.die)
+  close(k.readable)
+  close(k.writable)
+  close(k.acked)
+  k.notify()
 }
 
-func (k *KDP) execute_read(action *cmd) {
-  rslt := new(reply)
-  if data, err := k.kcp.receive(false); err != nil {
-    rslt.err = err
-  } else {
-    rslt.rslt = []interface{}{data}
+// notify tells the owner once the session failed or closed.
+func (k *KDP) notify() {
+  if !k.notified && k.on_done != nil {
+    k.notified = true
+    go k.on_done(k)
   }
-  k.update = true
-  go snd_rslt(rslt, action.pipe)
 }
 
-// need to write data here
-func (k *KDP) execute_write(action *cmd) {
-  rslt := new(reply)
-  if action.args == nil || len(action.args) < 1 {
-    rslt.err = errors.New("bad args")
-  } else if data, ok := action.args[0].([]byte); !ok {
-    rslt.err = errors.New("bad args")
-  } else {
-    rslt.err = k.kcp.send(data)
-  }
-  k.update = true
-  go snd_rslt(rslt, action.pipe)
+// set_fault wakes pending reads, writes and flushes, they and later
+// calls fail with err once the received data is consumed.
+func (k *KDP) set_fault(err error) {
+  k.fault = err
+  k.wake_readers()
+  k.wake_writers()
+  k.wake_flushes()
+  k.notify()
 }
 
-func (k *KDP) execute_input(action *cmd) {
-  rslt := new(reply)
-  if action.args == nil || len(action.args) < 1 {
-    rslt.err = errors.New("bad args")
-  } else if data, ok := action.args[0].([]byte); !ok {
-    rslt.err = errors.New("bad args")
-  } else {
-    rslt.err = k.kcp.input(data)
-  }
-  k.update = true
-  go snd_rslt(rslt, action.pipe)
+// wake_readers releases the reads waiting for data, they check again.
+func (k *KDP) wake_readers() {
+  close(k.readable)
+  k.readable = make(chan bool)
+  k.rd_waiting = false
 }
 
-// just report error
-func (k *KDP) unknown_action(action *cmd) {
-  rslt := new(reply)
-  rslt.err = errors.New("unknown command")
-  go snd_rslt(rslt, action.pipe)
+func (k *KDP) wake_writers() {
+  close(k.writable)
+  k.writable = make(chan bool)
+  k.wr_waiting = false
 }
 
-func (k *KDP) snd_rslt(rslt *reply, pipe chan *reply) {
-  defer recover()
-  if pipe == nil {
-    return
+func (k *KDP) wake_flushes() {
+  close(k.acked)
+  k.acked = make(chan bool)
+  k.ack_waiting = false
+}
+
+// notify_update asks the scheduler to update kcp, it does once the
+// flush interval allows.
+func (k *KDP) notify_update() {
+  k.sched.schedule(k.job, time.Now())
+}
+
+// update runs kcp at now, the time the scheduler runs the session, and
+// returns how long until the next update is due.
+func (k *KDP) update(now time.Time) time.Duration {
+  wait := KDP_INTERVAL
+  if k.pacer != nil {
+    // new data joins the window only after the paced packets left, or
+    // the backlog of a capped rate keeps growing until segments time out
+    k.kcp.SetHold(k.pacer.Len() > 0)
   }
-  select {
-    case <- time.After(1 * time.Second):
-    case pipe <- rslt:
+  current := clock_at(now) + k.clock_offset
+  k.kcp.Update(current)
+  if next := timediff(k.kcp.Check(current), current); next > 0 {
+    wait = time.Duration(next) * time.Millisecond
+  } else {
+    wait = time.Millisecond
+  }
+  if k.fault == nil && k.kcp.Dead() {
+    k.set_fault(ErrDeadLink)
+  } else if k.fault == nil && k.idle > 0 && k.kcp.Idle() >= k.idle {
+    k.set_fault(ErrIdleTimeout)
+  }
+  if k.pacer != nil {
+    k.pacer.SetRate(k.pacing_rate())
+  }
+  if k.wr_waiting && k.can_write() {
+    k.wake_writers()
   }
+  if k.closing && (k.kcp.Drained() || k.fault != nil || time.Now().After(k.linger_until)) {
+    k.finish_close()
+  } else if k.closing && wait > KDP_INTERVAL {
+    wait = KDP_INTERVAL
+  }
+  return wait
 }
 
-func (k *KDP) demon() {
-  trigger := time.NewTicker(KDP_INTERVAL)
-  var update_time uint32
-  for !k.close {
-    select {
-    case <- trigger.C:
-      current := clock()
-      if k.update || update_time <= current {
-        k.kcp.update(current)
-        update_time = k.kcp.check(current)
-        select {
-        case k.updated <- true:
-        default:
-        }
-      }
-    case action := <- k.event:
-      k.execute(action)
+// run is the job of the session in the scheduler, it returns when it's
+// due again.
+func (k *KDP) run(now time.Time) time.Time {
+  k.lock.Lock()
+  defer k.lock.Unlock()
+  if k.close {
+    return time.Time{}
+  }
+  wait := k.update(now)
+  if k.close {
+    return time.Time{}
+  } else if k.pacer != nil {
+    if pace := k.pace(now); pace > 0 && pace < wait {
+      wait = pace
     }
   }
+  return now.Add(wait)
 }
 
 type Client struct {
   udp  *net.UDPConn
   pipe *KDP
   buff []byte
-  close bool
+  ack  []byte
+  crypt *Crypt
+  // die is closed once the client shuts down
+  die chan bool
+  once sync.Once
+}
+
+// Dial connects to a kcp server at raddr, a nil config means DefaultConfig.
+// It returns after the server assigned the conv of the session.
+func Dial(raddr string, config *Config) (*Client, error) {
+  return DialContext(context.Background(), raddr, config)
 }
 
-func Dial(raddr string, id uint32) (*Client, error) {
+// DialContext is Dial giving up the handshake once ctx is done.
+func DialContext(ctx context.Context, raddr string, config *Config) (*Client, error) {
   client := new(Client)
-  if local, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0"); err != nil {
+  client.die = make(chan bool)
+  if config == nil {
+    config = DefaultConfig()
+  }
+  if err := config.Validate(); err != nil {
+    return nil, err
+  } else if local, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0"); err != nil {
     return nil, err
   } else if remote, err := net.ResolveUDPAddr("udp4", raddr); err != nil {
     return nil, err 
   } else if conn, err := net.ListenUDP("udp4", local); err != nil {
-    defer conn.Close()
+    return nil, err
+  } else if err := set_read_buffer(conn, config); err != nil {
+    conn.Close()
+    return nil, err
+  } else if crypt, err := config.crypt(true); err != nil {
+    conn.Close()
+    return nil, err
+  } else if conv, ack, session, err := client_handshake(ctx, conn, remote, crypt, config); err != nil {
+    conn.Close()
     return nil, err
   } else {
     client.udp = conn
-    client.pipe = NewKDP(id, conn, remote)
+    client.ack = ack
+    client.crypt = crypt
+    client.pipe = new(KDP)
+    client.pipe.crypt = session
+    client.pipe.init(conv, conn, remote, config)
   }
   go client.demon()
   return client, nil
@@ -321,121 +724,314 @@ func Dial(raddr string, id uint32) (*Client, error) {
 // Waiting data from server and 
 func (client *Client) demon() {
   buffer := make([]byte, 4096)
-  for !client.close {
+  for !client.closed() {
     client.udp.SetReadDeadline(time.Now().Add(10 * time.Second))
     cnt, err := client.udp.Read(buffer)
     if cnt == 0 || err != nil {
       continue
     }
+    // buffer stays intact for the handshake crypt, the session one may
+    // hold the traffic keys
     data := make([]byte, cnt)
     copy(data, buffer)
-    client.pipe.input(data)
+    // sealed handshake packets have seq 0, plain ones a handshake header
+    seq, pkt, err := client.pipe.crypt.Open(data)
+    if err == nil && (seq != 0 || client.pipe.crypt == nil && !is_handshake(pkt)) {
+      client.pipe.receive(seq, pkt)
+    } else if _, pkt, err := client.crypt.Open(buffer[:cnt]); err == nil {
+      // the server didn't get the last step of handshake
+      if seg := parse_handshake(pkt); seg != nil && seg.cmd == KCP_CMD_SYNACK && seg.conv == client.pipe.kcp.conv {
+        client.udp.WriteToUDP(client.crypt.Seal(client.ack, 0, 0), client.pipe.raddr)
+      }
+    }
   }
 }
 
 func (client *Client) Read(store []byte) (int, error) {
-  if client.close {
+  if client.closed() {
     return 0, errors.New("client closed")
   }
   return client.pipe.Read(store)
 }
 
-func (client *Client) Write(data []byte) error {
-  if client.close {
-    return errors.New("client closed")
+func (client *Client) ReadContext(ctx context.Context, store []byte) (int, error) {
+  if client.closed() {
+    return 0, errors.New("client closed")
+  }
+  return client.pipe.ReadContext(ctx, store)
+}
+
+func (client *Client) Write(data []byte) (int, error) {
+  if client.closed() {
+    return 0, errors.New("client closed")
   }
   return client.pipe.Write(data)
 }
 
-func (client *Client) Close() {
-  client.close = true
+func (client *Client) TryWrite(data []byte) (int, error) {
+  if client.closed() {
+    return 0, errors.New("client closed")
+  }
+  return client.pipe.TryWrite(data)
+}
+
+func (client *Client) WriteContext(ctx context.Context, data []byte) (int, error) {
+  if client.closed() {
+    return 0, errors.New("client closed")
+  }
+  return client.pipe.WriteContext(ctx, data)
+}
+
+// Close lingers until the data sent is acked, the socket keeps
+// receiving until then.
+func (client *Client) Close() error {
+  if client.closed() {
+    return errors.New("client closed")
+  }
   client.pipe.Close()
-  client.udp.Close()
+  return client.shutdown()
 }
 
-func (client *Client) Sync() {
-  client.pipe.Sync()
+// shutdown stops the demon and closes the socket, the session isn't
+// closed and the server isn't told.
+func (client *Client) shutdown() error {
+  err := errors.New("client closed")
+  client.once.Do(func() {
+    close(client.die)
+    err = client.udp.Close()
+  })
+  return err
 }
 
+func (client *Client) closed() bool {
+  select {
+  case <- client.die:
+    return true
+  default:
+    return false
+  }
+}
+
+func (client *Client) CloseWrite() error {
+  return client.pipe.CloseWrite()
+}
+
+func (client *Client) Stats() (*Stats, error) {
+  return client.pipe.Stats()
+}
+
+func (client *Client) Flush(ctx context.Context) error {
+  return client.pipe.Flush(ctx)
+}
+
+// Server keeps sessions by conv and by the client address, sessions with
+// keys of their own follow their client to a new address, see migrate.
 type Server struct {
   udp   *net.UDPConn
-  pipes map[string]*KDP
-  id    uint32
+  pipes map[uint32]*KDP
+  addrs map[string]*KDP
+  pending map[string]*half_open
+  config *Config
+  crypt  *Crypt
+  // key of the handshake cookies
+  secret []byte
+  // when the next SYN-ACK of a half open record is due
+  resend time.Time
+  sched  *scheduler
   event  chan *cmd
   accept chan *KDP
-  close  bool
+  reaped chan *KDP
+  // die is closed by the demon once the server is closed
+  die    chan bool
 }
 
-func Listen(laddr string, id uint32) (*Server, error) {
+// Listen waits for kcp clients on laddr, a nil config means DefaultConfig.
+func Listen(laddr string, config *Config) (*Server, error) {
   server := new(Server)
   server.init()
-  if local, err := net.ResolveUDPAddr("udp4", laddr); err != nil {
+  if config == nil {
+    config = DefaultConfig()
+  }
+  if err := config.Validate(); err != nil {
+    return nil, err
+  } else if local, err := net.ResolveUDPAddr("udp4", laddr); err != nil {
     return nil, err
   } else if conn, err := net.ListenUDP("udp4", local); err != nil {
-    defer conn.Close()
+    return nil, err
+  } else if err := set_read_buffer(conn, config); err != nil {
+    conn.Close()
+    return nil, err
+  } else if crypt, err := config.crypt(false); err != nil {
+    conn.Close()
     return nil, err
   } else {
     server.udp = conn
-    server.id = id
+    server.config = config
+    server.crypt = crypt
+    server.sched = new_scheduler()
   }
   go server.demon()
   return server, nil
 }
 
 func (server *Server) init() {
-  server.pipes = make(map[string]*KDP)
+  server.pipes = make(map[uint32]*KDP)
+  server.addrs = make(map[string]*KDP)
+  server.pending = make(map[string]*half_open)
+  server.secret = make([]byte, sha256.Size)
+  rand.Read(server.secret)
   server.event = make(chan *cmd)
   server.accept = make(chan *KDP, 1024)
-  server.close = false
+  server.reaped = make(chan *KDP, KDP_REAPED)
+  server.die = make(chan bool)
 }
 
-func (server *Server) Accept() (*KDP, error) {
-  for !server.close {
-    select {
-    case kdp := <- server.accept:
+// Accept waits for the next established session, it makes Server a
+// net.Listener.
+func (server *Server) Accept() (net.Conn, error) {
+  kdp, err := server.AcceptKDP()
+  if err != nil {
+    return nil, err
+  }
+  return kdp, nil
+}
+
+// AcceptKDP is Accept returning the session type.
+func (server *Server) AcceptKDP() (*KDP, error) {
+  return server.AcceptContext(context.Background())
+}
+
+// AcceptContext is AcceptKDP returning ctx.Err() once ctx is done.
+// Close wakes up pending calls.
+func (server *Server) AcceptContext(ctx context.Context) (*KDP, error) {
+  select {
+  case kdp, ok := <- server.accept:
+    if ok && !server.closed() {
       return kdp, nil
-    case <- time.After(time.Second):
     }
+  case <- ctx.Done():
+    return nil, ctx.Err()
   }
   return nil, errors.New("server closed")
 }
 
-func (server *Server) Close() {
+func (server *Server) Close() error {
   action := new(cmd)
   action.cmd = KDP_CLOSE
-  action.pipe = make(chan *reply)
-  server.event <- action
-  <- action.pipe
+  _, err := server.call(action)
+  return err
+}
+
+// Addr returns the local address the server listens on.
+func (server *Server) Addr() net.Addr {
+  return server.udp.LocalAddr()
 }
 
 func (server *Server) Break(kdp *KDP) {
-  defer recover()
   action := new(cmd)
   action.cmd = KDP_BREAK
-  action.pipe = make(chan *reply)
-  defer close(action.pipe)
   action.args = []interface{}{kdp}
-  server.event <- action
-  <- action.pipe
+  server.call(action)
+}
+
+// Stats returns a snapshot of every session, keyed by remote address.
+func (server *Server) Stats() (map[string]*Stats, error) {
+  action := new(cmd)
+  action.cmd = KDP_STATS
+  rslt, err := server.call(action)
+  if err != nil {
+    return nil, err
+  }
+  return rslt.rslt[0].(map[string]*Stats), nil
+}
+
+// call hands action to the demon and waits for its reply, it fails once
+// the server is closed.
+func (server *Server) call(action *cmd) (*reply, error) {
+  action.pipe = make(chan *reply)
+  select {
+  case server.event <- action:
+  case <- server.die:
+    return nil, errors.New("server closed")
+  }
+  // the demon answers every action it takes
+  return <- action.pipe, nil
+}
+
+func (server *Server) closed() bool {
+  select {
+  case <- server.die:
+    return true
+  default:
+    return false
+  }
+}
+
+// Reaped returns the sessions removed from the server, because they
+// were closed, their link died or they stayed idle past the timeout.
+// Err of the session tells which one. The channel holds KDP_REAPED
+// sessions, removals beyond that while no one reads it are dropped and
+// counted in ReapDrops of DefaultSnmp.
+func (server *Server) Reaped() <-chan *KDP {
+  return server.reaped
+}
+
+func (server *Server) new_session(conv uint32, raddr *net.UDPAddr, crypt *Crypt) *KDP {
+  k := new(KDP)
+  k.on_done = server.reap
+  k.sched = server.sched
+  k.crypt = crypt
+  k.init(conv, server.udp, raddr, server.config)
+  return k
+}
+
+// reap releases a failed or closed session and reports it, a failed one
+// keeps its error for later Read and Write.
+func (server *Server) reap(k *KDP) {
+  k.terminate(0)
+  server.Break(k)
+  select {
+  case server.reaped <- k:
+  default:
+    atomic.AddUint64(&DefaultSnmp.ReapDrops, 1)
+  }
 }
 
 // Waiting data from client
 func (server *Server) demon() {
   buffer := make([]byte, 2048)
-  for !server.close {
-    server.udp.SetReadDeadline(time.Now().Add(time.Second))
+  for !server.closed() {
+    server.resend_synacks()
+    deadline := time.Now().Add(time.Second)
+    if !server.resend.IsZero() && server.resend.Before(deadline) {
+      deadline = server.resend
+    }
+    server.udp.SetReadDeadline(deadline)
     cnt, raddr, err := server.udp.ReadFromUDP(buffer)
     if cnt == 0 || err != nil {
+    } else if pipe, ok := server.addrs[raddr.String()]; ok {
+      data := make([]byte, cnt)
+      copy(data, buffer)
+      if seq, pkt, err := pipe.crypt.Open(data); err == nil {
+        pipe.receive(seq, pkt)
+      }
+    } else if pipe := server.pipes[sealed_conv(buffer[:cnt])]; pipe != nil && pipe.crypt != nil && pipe.crypt != server.crypt {
+      data := make([]byte, cnt)
+      copy(data, buffer)
+      if seq, pkt, err := pipe.crypt.Open(data); err == nil {
+        server.migrate(pipe, seq, pkt, raddr)
+      }
     } else {
       data := make([]byte, cnt)
       copy(data, buffer)
-      if pipe, ok := server.pipes[raddr.String()]; !ok {
-        pipe = NewKDP(server.id, server.udp, raddr)
-        server.pipes[raddr.String()] = pipe
-        pipe.input(data)
+      _, pkt, err := server.crypt.Open(data)
+      if err != nil {
+        pkt = nil
+      }
+      if pipe := server.handshake(pkt, raddr); pipe != nil {
+        server.pipes[pipe.kcp.conv] = pipe
+        server.addrs[raddr.String()] = pipe
         server.accept <- pipe
-      } else {
-        pipe.input(data)
       }
     }
     select {
@@ -446,24 +1042,60 @@ func (server *Server) demon() {
   }
 }
 
+// migrate takes packets of a session from another address as its client
+// moving there, by NAT rebinding or a network handoff. Only sessions with
+// traffic keys of the key exchange move, the seal of those proves the
+// packet came from the client. Sessions under the pre-shared key or in
+// plaintext never move, any client with the key could seal packets of
+// them. The newest packet from the address gets a PING sent there, and
+// the session moves once a newer packet brings the PONG back from it.
+// The anti-replay filter keeps old packets from starting a move.
+func (server *Server) migrate(pipe *KDP, seq uint64, pkt []byte, raddr *net.UDPAddr) {
+  newest, pongs := seq > pipe.replay.top, pipe.pongs()
+  if err := pipe.receive(seq, pkt); err != nil || !newest {
+    return
+  } else if pipe.path == nil || pipe.path.String() != raddr.String() {
+    pipe.path, pipe.path_probe = raddr, time.Now()
+    pipe.probe(raddr)
+    return
+  } else if pipe.pongs() == pongs {
+    // the PING or its PONG may be lost
+    if time.Since(pipe.path_probe) >= KDP_HANDSHAKE_RESEND {
+      pipe.path_probe = time.Now()
+      pipe.probe(raddr)
+    }
+    return
+  }
+  pipe.path = nil
+  old := pipe.move(raddr).String()
+  if server.addrs[old] == pipe {
+    delete(server.addrs, old)
+  }
+  server.addrs[raddr.String()] = pipe
+  atomic.AddUint64(&DefaultSnmp.Migrations, 1)
+}
+
 func (server *Server) execute(action *cmd) {
-  defer recover()
+  defer func() { recover() }()
   switch action.cmd {
   case KDP_CLOSE:
     server.exec_close(action)
   case KDP_BREAK:
     server.exec_break(action)
+  case KDP_STATS:
+    server.exec_stats(action)
   default:
     server.unknown_action(action)
   }
 }
 
 func (server *Server) exec_close(action *cmd) {
+  // no one reads FIN-ACKs after this, sessions can't linger
   for _, v := range server.pipes {
-    v.Close()
+    v.terminate(0)
   }
-  server.close = true
-  close(server.event)
+  server.sched.stop()
+  close(server.die)
   close(server.accept)
   server.udp.Close()
   go snd_rslt(nil, action.pipe)
@@ -476,9 +1108,25 @@ func (server *Server) exec_break(action *cmd) {
   } else if pipe, ok := action.args[0].(*KDP); !ok {
     rslt.err = errors.New("bad args")
   } else {
-    raddr := pipe.raddr.String()
-    delete(server.pipes, raddr)
+    if conv := pipe.kcp.conv; server.pipes[conv] == pipe {
+      delete(server.pipes, conv)
+    }
+    if raddr := pipe.RemoteAddr().String(); server.addrs[raddr] == pipe {
+      delete(server.addrs, raddr)
+    }
+  }
+  go snd_rslt(rslt, action.pipe)
+}
+
+func (server *Server) exec_stats(action *cmd) {
+  rslt := new(reply)
+  stats := make(map[string]*Stats)
+  for _, pipe := range server.pipes {
+    if snapshot, err := pipe.Stats(); err == nil {
+      stats[pipe.RemoteAddr().String()] = snapshot
+    }
   }
+  rslt.rslt = []interface{}{stats}
   go snd_rslt(rslt, action.pipe)
 }
 
@@ -488,8 +1136,14 @@ func (server *Server) unknown_action(action *cmd) {
   action.pipe <- rslt
 }
 
+func set_read_buffer(conn *net.UDPConn, config *Config) error {
+  if config.ReadBuffer == 0 {
+    return nil
+  }
+  return conn.SetReadBuffer(config.ReadBuffer)
+}
+
 func snd_rslt(rslt *reply, pipe chan *reply) {
-  defer recover()
   select {
   case pipe <- rslt:
   case <- time.After(time.Second):
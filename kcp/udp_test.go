@@ -1,8 +1,14 @@
 package kcp
 
 import (
+  "io"
+  "context"
+  "os"
+  "net"
   "log"
   "fmt"
+  "time"
+  "sync"
   "strings"
   "testing"
 )
@@ -10,7 +16,7 @@ import (
 var finish = make(chan bool)
 
 func TestUDP(t *testing.T) {
-  server, err := Listen("0.0.0.0:9010", 1)
+  server, err := Listen("0.0.0.0:9010", nil)
   if err != nil {
     log.Printf("create server failed %v", err)
   }
@@ -18,11 +24,20 @@ func TestUDP(t *testing.T) {
   go serve(server, t, 1)
   snd(0, t)
   <- finish
+  if stats, err := server.Stats(); err != nil || len(stats) != 1 {
+    t.Errorf("server stats failed %v %v", stats, err)
+  } else {
+    for _, stat := range stats {
+      if stat.SegsRecv == 0 {
+        t.Errorf("server received nothing %v", stat)
+      }
+    }
+  }
   server.Close()
 }
 
 func TestMulti(t *testing.T) {
-  server, err := Listen("0.0.0.0:9010", 1)
+  server, err := Listen("0.0.0.0:9010", nil)
   if err != nil {
     log.Printf("create server failed %v", err)
   }
@@ -37,14 +52,444 @@ func TestMulti(t *testing.T) {
 }
 
 
+func TestUDPWrap(t *testing.T) {
+  server, err := Listen("0.0.0.0:9010", near_wrap(DefaultConfig()))
+  if err != nil {
+    log.Printf("create server failed %v", err)
+  }
+  
+  go serve(server, t, 1)
+  snd_with(0, near_wrap(DefaultConfig()), t)
+  <- finish
+  server.Close()
+}
+
+func TestClose(t *testing.T) {
+  server, err := Listen("0.0.0.0:9010", nil)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+  client, err := Dial("127.0.0.1:9010", nil)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  sock, err := server.Accept()
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  msg := []byte(strings.Repeat("close", 1000))
+  closed := make(chan bool, 1)
+  go func() {
+    for i := 0; i < 100; i++ {
+      client.Write(msg)
+    }
+    client.Close()
+    closed <- true
+  }()
+  
+  buffer, total := make([]byte, 10000), 0
+  for {
+    cnt, err := sock.Read(buffer)
+    if err == io.EOF {
+      break
+    } else if err != nil {
+      t.Fatalf("read failed %v", err)
+    }
+    total += cnt
+  }
+  if total != 100 * len(msg) {
+    t.Errorf("%d bytes read before eof, %d sent", total, 100 * len(msg))
+  }
+  // sock stays open, linger ends once the data is acked
+  select {
+  case <- closed:
+  case <- time.After(3 * time.Second):
+    t.Errorf("close waits for the remote side to close")
+  }
+}
+
+func TestDeadLinkUDP(t *testing.T) {
+  config := DefaultConfig()
+  config.DeadLink = 3
+  server, err := Listen("0.0.0.0:9010", config)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+  client, err := Dial("127.0.0.1:9010", nil)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  sock, err := server.AcceptKDP()
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  // the client goes away without FIN
+  client.shutdown()
+  
+  sock.Write([]byte("anyone there"))
+  select {
+  case dead := <- server.Reaped():
+    if dead != sock || dead.Err() != ErrDeadLink {
+      t.Errorf("wrong session reported dead %v", dead.Err())
+    }
+  case <- time.After(10 * time.Second):
+    t.Fatalf("dead link not reported")
+  }
+  if _, err := sock.Read(make([]byte, 100)); err != ErrDeadLink {
+    t.Errorf("read on dead link returns %v", err)
+  } else if _, err := sock.Write([]byte("again")); err != ErrDeadLink {
+    t.Errorf("write on dead link returns %v", err)
+  }
+  if stats, _ := server.Stats(); len(stats) != 0 {
+    t.Errorf("dead session not released")
+  }
+}
+
+func TestIdleTimeout(t *testing.T) {
+  config := DefaultConfig()
+  config.KeepAlive, config.IdleTimeout = 100, 500
+  server, err := Listen("0.0.0.0:9010", config)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+  client, err := Dial("127.0.0.1:9010", config)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  sock, err := server.AcceptKDP()
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  
+  // pings keep an idle session alive
+  time.Sleep(time.Second)
+  if sock.Err() != nil || client.pipe.Err() != nil {
+    t.Fatalf("answering session timed out %v/%v", sock.Err(), client.pipe.Err())
+  }
+  
+  client.shutdown()
+  select {
+  case idle := <- server.Reaped():
+    if idle != sock || idle.Err() != ErrIdleTimeout {
+      t.Errorf("wrong session reaped %v", idle.Err())
+    }
+  case <- time.After(3 * time.Second):
+    t.Fatalf("idle session not reaped")
+  }
+  if _, err := sock.Read(make([]byte, 100)); err != ErrIdleTimeout {
+    t.Errorf("read on idle session returns %v", err)
+  }
+}
+
+func TestDeadline(t *testing.T) {
+  var listener net.Listener
+  server, err := Listen("0.0.0.0:9010", nil)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  listener = server
+  defer listener.Close()
+  config := DefaultConfig()
+  config.Linger = -1
+  client, err := Dial("127.0.0.1:9010", config)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  defer client.Close()
+  conn, err := listener.Accept()
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  if conn.RemoteAddr().(*net.UDPAddr).Port != client.LocalAddr().(*net.UDPAddr).Port {
+    t.Errorf("remote addr %v, client at %v", conn.RemoteAddr(), client.LocalAddr())
+  }
+  
+  start := time.Now()
+  conn.SetReadDeadline(start.Add(200 * time.Millisecond))
+  if _, err := conn.Read(make([]byte, 100)); !os.IsTimeout(err) {
+    t.Fatalf("read past deadline returns %v", err)
+  } else if cost := time.Since(start); cost > time.Second {
+    t.Errorf("deadline hit after %v", cost)
+  }
+  
+  // moving the deadline wakes a blocked Read
+  conn.SetReadDeadline(time.Time{})
+  done := make(chan error, 1)
+  go func() {
+    _, err := conn.Read(make([]byte, 100))
+    done <- err
+  }()
+  time.Sleep(100 * time.Millisecond)
+  conn.SetReadDeadline(time.Now())
+  select {
+  case err := <- done:
+    if !os.IsTimeout(err) {
+      t.Errorf("woken read returns %v", err)
+    }
+  case <- time.After(500 * time.Millisecond):
+    t.Errorf("blocked read not woken")
+  }
+  
+  conn.SetDeadline(time.Time{})
+  if _, err := client.Write([]byte("hello")); err != nil {
+    t.Fatalf("write failed %v", err)
+  }
+  buffer := make([]byte, 100)
+  if cnt, err := conn.Read(buffer); err != nil || string(buffer[:cnt]) != "hello" {
+    t.Errorf("read %q %v after deadline cleared", buffer[:cnt], err)
+  }
+  client.SetWriteDeadline(time.Now())
+  if _, err := client.Write([]byte("late")); !os.IsTimeout(err) {
+    t.Errorf("write past deadline returns %v", err)
+  }
+}
+
+func TestContext(t *testing.T) {
+  // nobody answers the handshake
+  ctx, cancel := context.WithCancel(context.Background())
+  time.AfterFunc(100 * time.Millisecond, cancel)
+  start := time.Now()
+  if _, err := DialContext(ctx, "127.0.0.1:9010", nil); err != context.Canceled {
+    t.Errorf("cancelled dial returns %v", err)
+  } else if cost := time.Since(start); cost > time.Second {
+    t.Errorf("dial cancelled after %v", cost)
+  }
+  ctx, cancel = context.WithTimeout(context.Background(), 100 * time.Millisecond)
+  defer cancel()
+  if _, err := DialContext(ctx, "127.0.0.1:9010", nil); err != context.DeadlineExceeded {
+    t.Errorf("dial past deadline returns %v", err)
+  }
+  
+  server, err := Listen("0.0.0.0:9010", nil)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+  ctx, cancel = context.WithTimeout(context.Background(), 100 * time.Millisecond)
+  defer cancel()
+  if _, err := server.AcceptContext(ctx); err != context.DeadlineExceeded {
+    t.Errorf("accept past deadline returns %v", err)
+  }
+  
+  config := DefaultConfig()
+  config.Linger = -1
+  client, err := DialContext(context.Background(), "127.0.0.1:9010", config)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  defer client.Close()
+  sock, err := server.AcceptContext(context.Background())
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  ctx, cancel = context.WithCancel(context.Background())
+  time.AfterFunc(100 * time.Millisecond, cancel)
+  start = time.Now()
+  if _, err := sock.ReadContext(ctx, make([]byte, 100)); err != context.Canceled {
+    t.Errorf("cancelled read returns %v", err)
+  } else if cost := time.Since(start); cost > 500 * time.Millisecond {
+    t.Errorf("read cancelled after %v", cost)
+  }
+  if _, err := client.WriteContext(ctx, []byte("late")); err != context.Canceled {
+    t.Errorf("cancelled write returns %v", err)
+  }
+  if _, err := client.WriteContext(context.Background(), []byte("hello")); err != nil {
+    t.Fatalf("write failed %v", err)
+  }
+  buffer := make([]byte, 100)
+  if cnt, err := sock.ReadContext(context.Background(), buffer); err != nil || string(buffer[:cnt]) != "hello" {
+    t.Errorf("read %q %v", buffer[:cnt], err)
+  }
+}
+
+func TestSendBuffer(t *testing.T) {
+  server, err := Listen("0.0.0.0:9010", nil)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+  config := DefaultConfig()
+  config.Linger, config.SendBuffer = -1, 10000
+  client, err := Dial("127.0.0.1:9010", config)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  defer client.Close()
+  sock, err := server.AcceptKDP()
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  
+  // nobody reads, the receive window fills and the send buffer with it
+  msg, sent := []byte(strings.Repeat("b", 1000)), 0
+  for ; sent < 2000; sent++ {
+    client.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+    if _, err := client.Write(msg); os.IsTimeout(err) {
+      break
+    } else if err != nil {
+      t.Fatalf("write failed %v", err)
+    }
+  }
+  client.SetWriteDeadline(time.Time{})
+  if sent == 2000 {
+    t.Fatalf("write never blocked")
+  } else if _, err := client.TryWrite(msg); err != ErrWouldBlock {
+    t.Errorf("try write on full buffer returns %v", err)
+  }
+  if stats, _ := client.Stats(); stats.SndQueue + stats.SndBuf > 10 {
+    t.Errorf("%d segments buffered over the limit", stats.SndQueue + stats.SndBuf)
+  }
+  
+  done := make(chan int)
+  go func() {
+    buffer, total := make([]byte, 2000), 0
+    for total < (sent + 100) * len(msg) {
+      cnt, err := sock.Read(buffer)
+      if err != nil {
+        break
+      }
+      total += cnt
+    }
+    done <- total
+  }()
+  for i := 0; i < 100; i++ {
+    if _, err := client.Write(msg); err != nil {
+      t.Fatalf("write failed %v", err)
+    }
+  }
+  select {
+  case total := <- done:
+    if total != (sent + 100) * len(msg) {
+      t.Errorf("%d bytes read, %d sent", total, (sent + 100) * len(msg))
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatalf("blocked writes never drained")
+  }
+}
+
+func TestFlush(t *testing.T) {
+  server, err := Listen("0.0.0.0:9010", nil)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  config := DefaultConfig()
+  config.Linger = -1
+  client, err := Dial("127.0.0.1:9010", config)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  defer client.Close()
+  if _, err := server.AcceptKDP(); err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  
+  if err := client.Flush(context.Background()); err != nil {
+    t.Errorf("flush without data returns %v", err)
+  }
+  msg := []byte(strings.Repeat("f", 1000))
+  for i := 0; i < 100; i++ {
+    if _, err := client.Write(msg); err != nil {
+      t.Fatalf("write failed %v", err)
+    }
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+  defer cancel()
+  if err := client.Flush(ctx); err != nil {
+    t.Fatalf("flush returns %v", err)
+  } else if stats, _ := client.Stats(); stats.SndQueue + stats.SndBuf != 0 {
+    t.Errorf("%d segments unacked after flush", stats.SndQueue + stats.SndBuf)
+  }
+  
+  // nobody acks once the server is gone
+  server.Close()
+  client.Write(msg)
+  ctx, cancel = context.WithTimeout(context.Background(), 20 * time.Millisecond)
+  defer cancel()
+  if err := client.Flush(ctx); err != context.DeadlineExceeded {
+    t.Errorf("flush past deadline returns %v", err)
+  }
+  ctx, cancel = context.WithTimeout(context.Background(), 10 * time.Second)
+  defer cancel()
+  if err := client.Flush(ctx); err != ErrDeadLink {
+    t.Errorf("flush on dead link returns %v", err)
+  }
+}
+
+func TestReadWakeup(t *testing.T) {
+  server, err := Listen("0.0.0.0:9010", nil)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  config := DefaultConfig()
+  config.Linger = -1
+  client, err := Dial("127.0.0.1:9010", config)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  defer client.Close()
+  sock, err := server.AcceptKDP()
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  go func() {
+    buffer := make([]byte, 100)
+    for {
+      cnt, err := sock.Read(buffer)
+      if err != nil {
+        return
+      }
+      sock.Write(buffer[:cnt])
+    }
+  }()
+  
+  // a missed wakeup would stall the read past its deadline
+  buffer := make([]byte, 100)
+  for i := 0; i < 50; i++ {
+    msg := fmt.Sprintf("ping%d", i)
+    client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+    if _, err := client.Write([]byte(msg)); err != nil {
+      t.Fatalf("write failed %v", err)
+    } else if cnt, err := client.Read(buffer); err != nil {
+      t.Fatalf("round %d read failed %v", i, err)
+    } else if string(buffer[:cnt]) != msg {
+      t.Fatalf("read %q, want %q", buffer[:cnt], msg)
+    }
+  }
+  
+  done := make(chan error)
+  go func() {
+    _, err := server.Accept()
+    done <- err
+  }()
+  server.Close()
+  select {
+  case err := <- done:
+    if err == nil {
+      t.Errorf("accept on closed server succeeds")
+    }
+  case <- time.After(100 * time.Millisecond):
+    t.Errorf("accept not woken up by close")
+  }
+}
+
 func snd(start int, t *testing.T) {
-  client, err := Dial("127.0.0.1:9010", 1)
+  snd_with(start, DefaultConfig(), t)
+}
+
+func snd_with(start int, config *Config, t *testing.T) {
+  // writes block on the send buffer, the link must survive the losses of
+  // three senders without cwnd sharing one server socket
+  config.DeadLink = 100
+  client, err := Dial("127.0.0.1:9010", config)
   if err != nil {
     log.Printf("dial server failed")
   }
   for i := start; i < start + 3000; i++ {
     msg := strings.Repeat(fmt.Sprintf("msg%d", i), 700)
-    if err := client.Write([]byte(msg)); err != nil {
+    if _, err := client.Write([]byte(msg)); err != nil {
       log.Printf("client write failed %v", err)
     }
   }
@@ -73,3 +518,258 @@ func serve(s *Server, t *testing.T, cnt int) {
     }(j)
   }
 }
+
+func TestCryptUDP(t *testing.T) {
+  config := DefaultConfig()
+  config.Key, config.Crypt, config.Linger = "secret", "chacha20-poly1305", -1
+  server, err := Listen("0.0.0.0:9010", config)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+
+  // the server drops packets sealed with another key or not at all
+  for _, key := range []string{"guess", ""} {
+    wrong := DefaultConfig()
+    wrong.Key, wrong.Crypt = key, config.Crypt
+    if key == "" {
+      wrong.Crypt = ""
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 300 * time.Millisecond)
+    if _, err := DialContext(ctx, "127.0.0.1:9010", wrong); err != context.DeadlineExceeded {
+      t.Errorf("dial with key %q returns %v", key, err)
+    }
+    cancel()
+  }
+
+  client, err := Dial("127.0.0.1:9010", config)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  defer client.Close()
+  sock, err := server.AcceptKDP()
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  msg := []byte(strings.Repeat("c", 3000))
+  if _, err := client.Write(msg); err != nil {
+    t.Fatalf("write failed %v", err)
+  }
+  buffer := make([]byte, 4096)
+  total := 0
+  for total < len(msg) {
+    cnt, err := sock.Read(buffer[total:])
+    if err != nil {
+      t.Fatalf("read failed %v", err)
+    }
+    total += cnt
+  }
+  if string(buffer[:total]) != string(msg) {
+    t.Errorf("read %d bytes not matching the written ones", total)
+  }
+  if _, err := sock.Write([]byte("pong")); err != nil {
+    t.Fatalf("write back failed %v", err)
+  }
+  if cnt, err := client.Read(buffer); err != nil || string(buffer[:cnt]) != "pong" {
+    t.Errorf("client read %q %v", buffer[:cnt], err)
+  }
+}
+
+// nat relays a client to the server like a NAT, rebind moves the relay to
+// a new source port as a rebinding or handoff does.
+type nat struct {
+  lock sync.Mutex
+  front, back *net.UDPConn
+  client, server *net.UDPAddr
+  last []byte
+}
+
+func (n *nat) relay() {
+  buffer := make([]byte, 2048)
+  for {
+    cnt, from, err := n.front.ReadFromUDP(buffer)
+    if err != nil {
+      return
+    }
+    n.lock.Lock()
+    n.client, n.last = from, append([]byte(nil), buffer[:cnt]...)
+    back := n.back
+    n.lock.Unlock()
+    back.WriteToUDP(buffer[:cnt], n.server)
+  }
+}
+
+func (n *nat) rebind() error {
+  back, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+  if err != nil {
+    return err
+  }
+  n.lock.Lock()
+  old := n.back
+  n.back = back
+  n.lock.Unlock()
+  if old != nil {
+    old.Close()
+  }
+  go func() {
+    buffer := make([]byte, 2048)
+    for {
+      cnt, err := back.Read(buffer)
+      if err != nil {
+        return
+      }
+      n.lock.Lock()
+      client := n.client
+      n.lock.Unlock()
+      n.front.WriteToUDP(buffer[:cnt], client)
+    }
+  }()
+  return nil
+}
+
+func TestMigrate(t *testing.T) {
+  config := DefaultConfig()
+  config.Identity, _ = NewIdentity()
+  config.Linger = -1
+  server, err := Listen("0.0.0.0:9010", config)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+  n := &nat{server: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9010}}
+  if n.front, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+    t.Fatalf("listen failed %v", err)
+  }
+  defer n.front.Close()
+  if err := n.rebind(); err != nil {
+    t.Fatalf("bind failed %v", err)
+  }
+  go n.relay()
+
+  client, err := Dial(n.front.LocalAddr().String(), config)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  defer client.Close()
+  sock, err := server.AcceptKDP()
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  buffer := make([]byte, 100)
+  echo := func(msg string) {
+    sock.SetReadDeadline(time.Now().Add(3 * time.Second))
+    client.SetReadDeadline(time.Now().Add(3 * time.Second))
+    if _, err := client.Write([]byte(msg)); err != nil {
+      t.Fatalf("write failed %v", err)
+    } else if cnt, err := sock.Read(buffer); err != nil || string(buffer[:cnt]) != msg {
+      t.Fatalf("server read %q %v", buffer[:cnt], err)
+    } else if _, err := sock.Write([]byte(msg)); err != nil {
+      t.Fatalf("write back failed %v", err)
+    } else if cnt, err := client.Read(buffer); err != nil || string(buffer[:cnt]) != msg {
+      t.Fatalf("client read %q %v", buffer[:cnt], err)
+    }
+  }
+  echo("before")
+
+  migrations := DefaultSnmp.Copy().Migrations
+  n.lock.Lock()
+  captured := n.last
+  n.lock.Unlock()
+  if err := n.rebind(); err != nil {
+    t.Fatalf("rebind failed %v", err)
+  }
+  echo("after")
+  moved := n.back.LocalAddr().String()
+  if addr := sock.RemoteAddr().String(); addr != moved {
+    t.Errorf("session at %s, client moved to %s", addr, moved)
+  } else if DefaultSnmp.Copy().Migrations == migrations {
+    t.Errorf("migration not counted")
+  } else if stats, _ := server.Stats(); len(stats) != 1 {
+    t.Errorf("%d sessions after the move", len(stats))
+  }
+
+  // an old packet replayed from elsewhere doesn't move the session
+  spoof, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+  if err != nil {
+    t.Fatalf("listen failed %v", err)
+  }
+  defer spoof.Close()
+  spoof.WriteToUDP(captured, n.server)
+  echo("again")
+  if addr := sock.RemoteAddr().String(); addr != moved {
+    t.Errorf("replayed packet moved the session to %s", addr)
+  }
+}
+
+func TestMigrateShared(t *testing.T) {
+  config := DefaultConfig()
+  config.Key, config.Linger = "secret", -1
+  server, err := Listen("0.0.0.0:9010", config)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  defer server.Close()
+  client, err := Dial("127.0.0.1:9010", config)
+  if err != nil {
+    t.Fatalf("dial server failed %v", err)
+  }
+  defer client.Close()
+  sock, err := server.AcceptKDP()
+  if err != nil {
+    t.Fatalf("accept failed %v", err)
+  }
+  addr := sock.RemoteAddr().String()
+  
+  // another holder of the key seals a packet of the session far ahead
+  spoof, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+  if err != nil {
+    t.Fatalf("listen failed %v", err)
+  }
+  defer spoof.Close()
+  crypt, _ := NewCrypt("", "secret", true)
+  ping := make([]byte, KCP_OVERHEAD)
+  (&Segment{conv: sock.kcp.conv, cmd: KCP_CMD_PING, wnd: 32}).Encode(ping)
+  spoof.WriteToUDP(crypt.Seal(ping, sock.kcp.conv, 1 << 40), client.pipe.raddr)
+  
+  sock.SetReadDeadline(time.Now().Add(3 * time.Second))
+  buffer := make([]byte, 100)
+  if _, err := client.Write([]byte("still")); err != nil {
+    t.Fatalf("write failed %v", err)
+  } else if cnt, err := sock.Read(buffer); err != nil || string(buffer[:cnt]) != "still" {
+    t.Fatalf("session broken by a forged packet %q %v", buffer[:cnt], err)
+  } else if now := sock.RemoteAddr().String(); now != addr {
+    t.Errorf("session under a shared key moved to %s", now)
+  }
+}
+
+func TestServerClosed(t *testing.T) {
+  server, err := Listen("0.0.0.0:9010", nil)
+  if err != nil {
+    t.Fatalf("create server failed %v", err)
+  }
+  // calls racing with Close fail instead of panicking or blocking
+  done := make(chan bool)
+  for i := 0; i < 4; i++ {
+    go func() {
+      for j := 0; j < 100; j++ {
+        server.Stats()
+      }
+      done <- true
+    }()
+  }
+  if err := server.Close(); err != nil {
+    t.Errorf("close failed %v", err)
+  }
+  for i := 0; i < 4; i++ {
+    select {
+    case <- done:
+    case <- time.After(time.Second):
+      t.Fatalf("stats blocked by close")
+    }
+  }
+  if _, err := server.Stats(); err == nil {
+    t.Errorf("stats of closed server succeeds")
+  } else if err := server.Close(); err == nil {
+    t.Errorf("second close succeeds")
+  }
+}
@@ -3,6 +3,7 @@ package transfer
 import (
   "os"
   "log"
+  "context"
   "fmt"
   "path"
   "time"
@@ -18,11 +19,11 @@ import (
 
 const (
   TIMEOUT    = 30 * time.Second
-  BLOCK_SIZE = 1024 * 16
+  BLOCK_SIZE = 1024 * 256
   ASK_WND = 5
 )
 
-func SendFile(name string, raddr string) error {
+func SendFile(name string, raddr string, config *kcp.Config) error {
   var (
     info os.FileInfo
     file *os.File
@@ -36,7 +37,7 @@ func SendFile(name string, raddr string) error {
   } else if file, err = os.OpenFile(name, os.O_RDONLY, 0); err != nil {
     log.Printf("client open send file %s failed %s", name, err.Error())
     return err
-  } else if client, err = kcp.Dial(raddr, 1); err != nil {
+  } else if client, err = kcp.Dial(raddr, StreamConfig(config)); err != nil {
     log.Printf("client dial server %s error %s", raddr, err.Error())
     return err
   }
@@ -45,8 +46,9 @@ func SendFile(name string, raddr string) error {
   if err := SendFileProc(point, info, file); err != nil {
     return err
   }
-  client.Sync()
-  return nil
+  ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+  defer cancel()
+  return client.Flush(ctx)
 }
 
 func SendFileProc(point *EndPoint, info os.FileInfo, file *os.File) error {
@@ -80,7 +82,7 @@ func SendFileProc(point *EndPoint, info os.FileInfo, file *os.File) error {
   return nil
 }
 
-func RecvFile(name string, dest string, raddr string) error {
+func RecvFile(name string, dest string, raddr string, config *kcp.Config) error {
   flags := os.O_RDWR | os.O_CREATE
   var (
     cfile  *os.File
@@ -97,7 +99,7 @@ func RecvFile(name string, dest string, raddr string) error {
     return err
   } else if file, err = os.OpenFile(dest, flags, 0660); err != nil {
     return err
-  } else if client, err = kcp.Dial(raddr, 1); err != nil {
+  } else if client, err = kcp.Dial(raddr, StreamConfig(config)); err != nil {
     return err
   }
   point = NewEndPoint(1, client)
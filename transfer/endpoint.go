@@ -19,7 +19,7 @@ import (
 )
 
 type Pipe interface {
-  Write(data []byte) error
+  Write(data []byte) (int, error)
   Read(store []byte) (int, error)
 }
 
@@ -136,7 +136,7 @@ func (end *EndPoint) SendInit(info os.FileInfo, timeout time.Duration) error {
   if body, err := EncodeMesg(mesg); err != nil {
     return err
   } else {
-    return end.sock.Write(body)
+    return end.write(body)
   }
 }
 
@@ -146,7 +146,7 @@ func (end *EndPoint) AskPartial(index []uint32) error {
   if body, err := EncodeMesg(mesg); err != nil {
     return err
   } else {
-    return end.sock.Write(body)
+    return end.write(body)
   }
 }
 
@@ -163,7 +163,7 @@ func (end *EndPoint) RecvInit(name string, total, block, cnt uint32) error {
   if body, err := EncodeMesg(mesg); err != nil {
     return err
   } else {
-    return end.sock.Write(body)
+    return end.write(body)
   }
 }
 
@@ -173,7 +173,7 @@ func (end *EndPoint) Error(code uint32) error {
   if body, err := EncodeMesg(mesg); err != nil {
     return err
   } else {
-    return end.sock.Write(body)
+    return end.write(body)
   }
 }
 
@@ -186,12 +186,22 @@ func (end *EndPoint) SendPartial(index uint32, data []byte) error {
   if body, err := EncodeMesg(mesg); err != nil {
     return err
   } else {
-    return end.sock.Write(body)
+    return end.write(body)
   }
 }
 
+type read_rslt struct {
+  mesg []byte
+  err  error
+}
+
+func (end *EndPoint) write(body []byte) error {
+  _, err := end.sock.Write(body)
+  return err
+}
+
 func (end *EndPoint) ReadMessageTimeout(timeout time.Duration) (*msg.Transfer, error) {
-  signal := make(chan []byte)
+  signal := make(chan *read_rslt)
   go read_proc(end.sock, signal)
   defer close(signal)
   
@@ -201,15 +211,12 @@ func (end *EndPoint) ReadMessageTimeout(timeout time.Duration) (*msg.Transfer, e
   )
 
   if timeout == 0 {
-    if mesg = <- signal; mesg == nil {
-      err = errors.New("read message failed")
-    }
+    rslt := <- signal
+    mesg, err = rslt.mesg, rslt.err
   } else {
     select {
-    case mesg = <- signal:
-      if mesg == nil {
-        err = errors.New("read message failed")
-      }
+    case rslt := <- signal:
+      mesg, err = rslt.mesg, rslt.err
     case <- time.After(timeout):
       err = errors.New("read message timeout")
     }
@@ -228,16 +235,18 @@ func (end *EndPoint) ReadMessageTimeout(timeout time.Duration) (*msg.Transfer, e
 }
 
 
-func read_proc(sock Pipe, signal chan []byte) {
+func read_proc(sock Pipe, signal chan *read_rslt) {
   defer recover()
-  var rslt []byte
+  rslt := new(read_rslt)
   header := make([]byte, 4)
   if dlen, err := ReadHeader(header, sock); err != nil {
     log.Printf("read message header failed %s", err.Error())
+    rslt.err = err
   } else if mesg, err := ReadMessage(dlen, sock); err != nil {
     log.Printf("read message body failed %s", err.Error())
+    rslt.err = err
   } else {
-    rslt = mesg
+    rslt.mesg = mesg
   }
   select{
   case signal <- rslt:
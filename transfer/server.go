@@ -15,11 +15,11 @@ type server struct {
   host, dest string
 }
 
-func Serve(host string, dest string) error {
+func Serve(host string, dest string, config *kcp.Config) error {
   s := new(server)
   s.host, s.dest = host, dest
 
-  server, err := kcp.Listen(host, 1)
+  server, err := kcp.Listen(host, StreamConfig(config))
   if err != nil {
     return err
   }
@@ -28,7 +28,10 @@ func Serve(host string, dest string) error {
     if err != nil {
       return err
     }
-    go s.process(kdp) 
+    go func() {
+      s.process(kdp)
+      kdp.Close()
+    }()
   }
 }
 
@@ -8,6 +8,7 @@ import (
 )
 
 import "github.com/golang/protobuf/proto"
+import "github.com/jellybean4/kcp_tran/kcp"
 import "github.com/jellybean4/kcp_tran/msg"
 
 func CheckSum(data []byte) []byte {
@@ -83,7 +84,7 @@ func ReadHeader(store []byte, sock Pipe) (uint32, error) {
 func ReadMessage(dlen uint32, sock Pipe) ([]byte, error) {
   buffer := make([]byte, dlen)
   if err := ReadData(buffer, sock); err != nil {
-    return nil, nil
+    return nil, err
   } else {
     return buffer, nil
   }
@@ -93,7 +94,7 @@ func ReadData(store []byte, sock Pipe) error {
   size := 0
   for size < len(store) {
     if cnt, err := sock.Read(store[size:]); err != nil {
-      return nil
+      return err
     } else {
       size += cnt
     }
@@ -124,3 +125,14 @@ func CloseFiles(files... *os.File) {
 func ConfigName(name string) string {
   return name + ".download"
 }
+
+// StreamConfig returns a copy of config with stream mode enabled, messages
+// are length prefixed so blocks larger than the fragment limit can be sent.
+func StreamConfig(config *kcp.Config) *kcp.Config {
+  if config == nil {
+    config = kcp.DefaultConfig()
+  }
+  rslt := *config
+  rslt.Stream = true
+  return &rslt
+}